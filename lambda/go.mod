@@ -9,6 +9,7 @@ require (
 	github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue v1.20.5
 	github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression v1.8.5
 	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.49.0
+	github.com/aws/aws-sdk-go-v2/service/scheduler v1.13.4
 	github.com/aws/aws-sdk-go-v2/service/secretsmanager v1.38.0
 )
 
@@ -38,6 +38,25 @@ type PresenceDefinition struct {
 	SystemPresence string `json:"systemPresence"`
 }
 
+type RoutingStatusEventBody struct {
+	RoutingStatus RoutingStatus `json:"routingStatus"`
+}
+
+type RoutingStatus struct {
+	Status    string    `json:"status"`
+	StartTime time.Time `json:"startTime"`
+}
+
+type StationEventBody struct {
+	AssociatedStation *UserStation `json:"associatedStation"`
+}
+
+type UserStation struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	AssociatedDate time.Time `json:"associatedDate"`
+}
+
 type ConversationSummaryEventBody struct {
 	Call             ChannelMetrics `json:"call"`
 	Callback         ChannelMetrics `json:"callback"`
@@ -57,3 +76,16 @@ type ChannelActivity struct {
 	Active int `json:"active"`
 	ACW    int `json:"acw"`
 }
+
+// Channels returns the metrics of every channel, keyed by the channel's JSON name
+func (b ConversationSummaryEventBody) Channels() map[string]ChannelMetrics {
+	return map[string]ChannelMetrics{
+		"call":             b.Call,
+		"callback":         b.Callback,
+		"chat":             b.Chat,
+		"email":            b.Email,
+		"message":          b.Message,
+		"socialExpression": b.SocialExpression,
+		"video":            b.Video,
+	}
+}
@@ -0,0 +1,467 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBStore is the Store for the user activity table and its list GSI in DynamoDB
+type DynamoDBStore struct {
+	tableName string
+	listGSI   string
+
+	once   sync.Once
+	client *dynamodb.Client
+	err    error
+}
+
+func NewDynamoDBStore(tableName string, listGSI string) *DynamoDBStore {
+	return &DynamoDBStore{
+		tableName: tableName,
+		listGSI:   listGSI,
+	}
+}
+
+// NewDynamoDBStoreFromEnv returns a DynamoDBStore for the DYNAMODB_TABLE table and its DYNAMODB_GSI_LIST index
+func NewDynamoDBStoreFromEnv() *DynamoDBStore {
+	return NewDynamoDBStore(os.Getenv("DYNAMODB_TABLE"), os.Getenv("DYNAMODB_GSI_LIST"))
+}
+
+func (s *DynamoDBStore) getClient(ctx context.Context) (*dynamodb.Client, error) {
+	s.once.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			s.err = fmt.Errorf("failed to load AWS config: %w", err)
+			return
+		}
+		s.client = dynamodb.NewFromConfig(cfg)
+	})
+	return s.client, s.err
+}
+
+func (s *DynamoDBStore) GetUserActivity(ctx context.Context, userID string) (*UserActivityEntity, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get user activity from DynamoDB
+	pk := UserActivityPK(userID)
+	sk := UserActivitySK(userID)
+	av, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &s.tableName,
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{Value: pk},
+			"_sk": &types.AttributeValueMemberS{Value: sk},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get UserActivity from DynamoDB: %v", err)
+	}
+
+	if av == nil || len(av.Item) == 0 {
+		return nil, nil
+	}
+
+	// Unmarshal the DB record into a UserActivityEntity object
+	var entity UserActivityEntity
+	err = attributevalue.UnmarshalMap(av.Item, &entity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal UserActivity from DynamoDB: %v", err)
+	}
+
+	return &entity, nil
+}
+
+func (s *DynamoDBStore) PutUserActivity(ctx context.Context, entity UserActivityEntity, expectedVersion *int64) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Convert to DynamoDB object
+	av, err := attributevalue.MarshalMap(entity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal UserActivity to DynamoDB: %v", err)
+	}
+
+	// Add the write condition
+	var condition expression.ConditionBuilder
+	if expectedVersion == nil {
+		condition = expression.AttributeNotExists(expression.Name("_pk"))
+	} else if *expectedVersion == 0 {
+		// Records written before versioning was introduced don't have a version
+		condition = expression.AttributeNotExists(expression.Name("version")).
+			Or(expression.Name("version").Equal(expression.Value(*expectedVersion)))
+	} else {
+		condition = expression.Name("version").Equal(expression.Value(*expectedVersion))
+	}
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %v", err)
+	}
+
+	// Write to DynamoDB
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 &s.tableName,
+		Item:                      av,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckFailed) {
+		return conflictError(entity.UserID, expectedVersion)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write UserActivity to DynamoDB: %v", err)
+	}
+
+	return nil
+}
+
+func (s *DynamoDBStore) QueryUserActivity(ctx context.Context, listPK string, beforeSK *string) ([]UserActivityEntity, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Define query conditions
+	keyCondition := expression.Key("_gsi_list_pk").Equal(expression.Value(listPK))
+
+	// Add sort key condition if beforeSK is provided
+	if beforeSK != nil {
+		keyCondition = expression.KeyAnd(keyCondition, expression.Key("_gsi_list_sk").LessThan(expression.Value(*beforeSK)))
+	}
+
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCondition).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build expression: %v", err)
+	}
+
+	// Query the GSI to get all items with the specified status
+	query := &dynamodb.QueryInput{
+		TableName:                 &s.tableName,
+		IndexName:                 aws.String(s.listGSI),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+
+	// Collect all results across all pages
+	var entities []UserActivityEntity
+	var lastEvaluatedKey map[string]types.AttributeValue
+
+	for {
+		// Set the exclusive start key for pagination
+		if lastEvaluatedKey != nil {
+			query.ExclusiveStartKey = lastEvaluatedKey
+		}
+
+		result, err := client.Query(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query UserActivity from DynamoDB: %v", err)
+		}
+
+		// Process items from this page
+		for _, item := range result.Items {
+			var entity UserActivityEntity
+			err := attributevalue.UnmarshalMap(item, &entity)
+			if err != nil {
+				fmt.Printf("Warning: failed to unmarshal item: %v\n", err)
+				continue
+			}
+			entities = append(entities, entity)
+		}
+
+		// Check if there are more pages
+		if result.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = result.LastEvaluatedKey
+	}
+
+	return entities, nil
+}
+
+func (s *DynamoDBStore) QueryUserActivityPage(ctx context.Context, listPK string, cursor string, limit int32) ([]UserActivityEntity, string, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyCondition := expression.Key("_gsi_list_pk").Equal(expression.Value(listPK))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCondition).Build()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to build expression: %v", err)
+	}
+
+	query := &dynamodb.QueryInput{
+		TableName:                 &s.tableName,
+		IndexName:                 aws.String(s.listGSI),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Limit:                     aws.Int32(limit),
+	}
+
+	// The cursor is the JSON of the last evaluated key, whose attributes are all strings
+	if cursor != "" {
+		var key map[string]string
+		if err := json.Unmarshal([]byte(cursor), &key); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %v", err)
+		}
+		query.ExclusiveStartKey, err = attributevalue.MarshalMap(key)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal cursor: %v", err)
+		}
+	}
+
+	result, err := client.Query(ctx, query)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query UserActivity from DynamoDB: %v", err)
+	}
+
+	var entities []UserActivityEntity
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &entities); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal UserActivity from DynamoDB: %v", err)
+	}
+
+	if result.LastEvaluatedKey == nil {
+		return entities, "", nil
+	}
+	var key map[string]string
+	if err := attributevalue.UnmarshalMap(result.LastEvaluatedKey, &key); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal last evaluated key: %v", err)
+	}
+	next, err := json.Marshal(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal cursor: %v", err)
+	}
+	return entities, string(next), nil
+}
+
+func (s *DynamoDBStore) PutReaperEvent(ctx context.Context, entity ReaperEventEntity) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	av, err := attributevalue.MarshalMap(entity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ReaperEvent to DynamoDB: %v", err)
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &s.tableName,
+		Item:      av,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write ReaperEvent to DynamoDB: %v", err)
+	}
+
+	return nil
+}
+
+func (s *DynamoDBStore) QueryReaperEvents(ctx context.Context, listPK string, sinceSK string) ([]ReaperEventEntity, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keyCondition := expression.KeyAnd(
+		expression.Key("_gsi_list_pk").Equal(expression.Value(listPK)),
+		expression.Key("_gsi_list_sk").GreaterThan(expression.Value(sinceSK)),
+	)
+
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCondition).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build expression: %v", err)
+	}
+
+	query := &dynamodb.QueryInput{
+		TableName:                 &s.tableName,
+		IndexName:                 aws.String(s.listGSI),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(false),
+	}
+
+	// Collect all results across all pages
+	var entities []ReaperEventEntity
+	var lastEvaluatedKey map[string]types.AttributeValue
+
+	for {
+		// Set the exclusive start key for pagination
+		if lastEvaluatedKey != nil {
+			query.ExclusiveStartKey = lastEvaluatedKey
+		}
+
+		result, err := client.Query(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query ReaperEvent from DynamoDB: %v", err)
+		}
+
+		// Process items from this page
+		for _, item := range result.Items {
+			var entity ReaperEventEntity
+			err := attributevalue.UnmarshalMap(item, &entity)
+			if err != nil {
+				fmt.Printf("Warning: failed to unmarshal item: %v\n", err)
+				continue
+			}
+			entities = append(entities, entity)
+		}
+
+		// Check if there are more pages
+		if result.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = result.LastEvaluatedKey
+	}
+
+	return entities, nil
+}
+
+func (s *DynamoDBStore) PutLease(ctx context.Context, entity LeaseEntity, acquire bool) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	av, err := attributevalue.MarshalMap(entity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Lease to DynamoDB: %v", err)
+	}
+
+	condition := expression.Name("owner").Equal(expression.Value(entity.Owner))
+	if acquire {
+		// A lease that expired before this acquisition (its first heartbeat) can be taken over
+		condition = expression.AttributeNotExists(expression.Name("_pk")).
+			Or(expression.Name("expiresAt").LessThan(expression.Value(entity.HeartbeatAt))).
+			Or(condition)
+	}
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %v", err)
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                           &s.tableName,
+		Item:                                av,
+		ConditionExpression:                 expr.Condition(),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckFailed) {
+		// Report the current holder of the lease
+		var held LeaseEntity
+		_ = attributevalue.UnmarshalMap(conditionalCheckFailed.Item, &held)
+		return &LeaseHeldError{Name: entity.Name, Owner: held.Owner, ExpiresAt: held.ExpiresAt}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write Lease to DynamoDB: %v", err)
+	}
+
+	return nil
+}
+
+func (s *DynamoDBStore) DeleteLease(ctx context.Context, name string, owner string) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	expr, err := expression.NewBuilder().WithCondition(expression.Name("owner").Equal(expression.Value(owner))).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %v", err)
+	}
+
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &s.tableName,
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{Value: LeasePK(name)},
+			"_sk": &types.AttributeValueMemberS{Value: LeasePK(name)},
+		},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckFailed) {
+		// The lease expired and was taken over, there is nothing to release
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete Lease from DynamoDB: %v", err)
+	}
+
+	return nil
+}
+
+func (s *DynamoDBStore) GetCursor(ctx context.Context, name string) (*CursorEntity, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	av, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &s.tableName,
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{Value: CursorPK(name)},
+			"_sk": &types.AttributeValueMemberS{Value: CursorPK(name)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Cursor from DynamoDB: %v", err)
+	}
+	if av == nil || len(av.Item) == 0 {
+		return nil, nil
+	}
+
+	var entity CursorEntity
+	if err := attributevalue.UnmarshalMap(av.Item, &entity); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal Cursor from DynamoDB: %v", err)
+	}
+	return &entity, nil
+}
+
+func (s *DynamoDBStore) PutCursor(ctx context.Context, entity CursorEntity) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	av, err := attributevalue.MarshalMap(entity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Cursor to DynamoDB: %v", err)
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &s.tableName,
+		Item:      av,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write Cursor to DynamoDB: %v", err)
+	}
+
+	return nil
+}
@@ -2,36 +2,26 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"user-activity-monitor/src/genesys"
+	"user-activity-monitor/src/scheduler"
 )
 
-var userActivityTableName = os.Getenv("DYNAMODB_TABLE")
-var userActivityListGSI = os.Getenv("DYNAMODB_GSI_LIST")
-var client *dynamodb.Client
+var store Store
 var ctx = context.Background()
+var reapScheduler scheduler.Scheduler
 
-func init() {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		panic(err)
-	}
-	client = dynamodb.NewFromConfig(cfg)
-}
+// maxWriteAttempts is the number of times a change is re-applied when the record is updated concurrently
+const maxWriteAttempts = 3
 
-func CreateUserActivity(userID string) *UserActivity {
+// CreateUserActivity creates a new UserActivity object from the current Genesys user data
+func CreateUserActivity(ctx context.Context, gc genesys.Client, userID string) *UserActivity {
 	ua := UserActivity{
 		UserID: userID,
 	}
-	ua.RefreshUser()
+	ua.RefreshUser(ctx, gc)
 	return &ua
 }
 
@@ -45,126 +35,276 @@ func WriteUserActivity(ua UserActivity, isLogoutAction bool) error {
 		ua.CheckActivity()
 	}
 
+	return SaveUserActivity(ua)
+}
+
+// SaveUserActivity writes a UserActivity object to the user activity table as-is, without re-checking its activity.
+// The write is conditional on the version the record was read with; a *ConflictError is returned if the record was
+// updated after it was read.
+func SaveUserActivity(ua UserActivity) error {
+	var expectedVersion *int64
+	if ua.persisted {
+		expectedVersion = &[]int64{ua.Version}[0]
+	}
+
+	ua.Version++
+	return putUserActivity(ua, expectedVersion)
+}
+
+// SaveUserActivityChange applies the change to a UserActivity object that was read earlier and writes it. If the
+// record was updated after it was read, the stored record is re-read and the change re-applied. If apply returns
+// false, nothing is written.
+func SaveUserActivityChange(ua UserActivity, apply func(ua *UserActivity) bool) error {
+	for attempt := 1; ; attempt++ {
+		if !apply(&ua) {
+			return nil
+		}
+
+		err := SaveUserActivity(ua)
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) || attempt >= maxWriteAttempts {
+			return err
+		}
+		fmt.Printf("%v, re-applying change (attempt %d)\n", conflict, attempt)
+
+		stored, err := ReadUserActivity(ua.UserID)
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			return conflict
+		}
+		ua = *stored
+	}
+}
+
+func putUserActivity(ua UserActivity, expectedVersion *int64) error {
 	// Update last updated timestamp
 	ua.LastUpdated = time.Now().UnixMilli()
 
-	// Convert to DynamoDB object
-	av, err := attributevalue.MarshalMap(ua.Entity())
+	if err := store.PutUserActivity(ctx, ua.Entity(), expectedVersion); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully wrote for %s\n", ua.UserID)
+
+	// Keep the user's reap schedule in line with the new due time
+	syncReapSchedule(ua)
+
+	return nil
+}
+
+// SetScheduler sets the backend used to schedule per-user reaps (nil disables per-user scheduling)
+func SetScheduler(s scheduler.Scheduler) {
+	reapScheduler = s
+}
+
+// syncReapSchedule creates, updates or deletes the user's reap schedule if the due time has changed since the record
+// was read
+func syncReapSchedule(ua UserActivity) {
+	if reapScheduler == nil {
+		return
+	}
+
+	dueAt := ua.scheduledDueAt()
+	if dueAt == nil && ua.storedDueAt == nil {
+		return
+	}
+	if dueAt != nil && ua.storedDueAt != nil && *dueAt == *ua.storedDueAt {
+		return
+	}
+
+	var err error
+	if dueAt == nil {
+		err = reapScheduler.Cancel(ctx, ua.UserID)
+	} else {
+		err = reapScheduler.Schedule(ctx, ua.UserID, time.UnixMilli(*dueAt))
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal UserActivity to DynamoDB: %v", err)
+		// The polling reaper still picks the user up
+		fmt.Printf("failed to update reap schedule: %v\n", err)
 	}
+}
 
-	// Write to DynamoDB
-	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: &userActivityTableName,
-		Item:      av,
+// ClaimUserActivity claims a due UserActivity record for the owner until the time (in milliseconds), so that only one
+// reaper invocation processes it. It returns the claimed record, or nil if the record is no longer due or another owner
+// holds an unexpired claim.
+func ClaimUserActivity(ua UserActivity, owner string, until int64) (*UserActivity, error) {
+	claimed := false
+	err := SaveUserActivityChange(ua, func(stored *UserActivity) bool {
+		now := time.Now().UnixMilli()
+		if !stored.IsDue(now) || stored.IsClaimedByOther(owner, now) {
+			claimed = false
+			return false
+		}
+		stored.Claim(owner, until)
+		ua = *stored
+		claimed = true
+		return true
 	})
+	if err != nil || !claimed {
+		return nil, err
+	}
+
+	// Return the record as written
+	ua.Version++
+	ua.storedDueAt = ua.scheduledDueAt()
+	return &ua, nil
+}
 
+// ReleaseUserActivityClaim releases the owner's claim on the UserActivity record, unless another owner has claimed it
+// in the meantime
+func ReleaseUserActivityClaim(ua UserActivity, owner string) error {
+	return SaveUserActivityChange(ua, func(stored *UserActivity) bool {
+		if stored.ClaimedBy != owner {
+			return false
+		}
+		stored.ReleaseClaim()
+		return true
+	})
+}
+
+// AcquireLease takes the named lease for the owner for the duration. A *LeaseHeldError is returned if another owner
+// holds the lease and it has not expired.
+func AcquireLease(name string, owner string, duration time.Duration) (*Lease, error) {
+	now := time.Now()
+	lease := Lease{
+		Name:        name,
+		Owner:       owner,
+		ExpiresAt:   now.Add(duration).UnixMilli(),
+		HeartbeatAt: now.UnixMilli(),
+	}
+
+	err := store.PutLease(ctx, lease.Entity(), true)
 	if err != nil {
-		return fmt.Errorf("failed to write UserActivity to DynamoDB: %v", err)
+		return nil, err
 	}
 
-	fmt.Printf("Successfully wrote for %s\n", ua.UserID)
+	return &lease, nil
+}
+
+// RenewLease extends the lease by the duration from now. A *LeaseHeldError is returned if the lease was lost to
+// another owner.
+func RenewLease(lease *Lease, duration time.Duration) error {
+	now := time.Now()
+	renewed := *lease
+	renewed.ExpiresAt = now.Add(duration).UnixMilli()
+	renewed.HeartbeatAt = now.UnixMilli()
+
+	err := store.PutLease(ctx, renewed.Entity(), false)
+	if err != nil {
+		return err
+	}
+
+	*lease = renewed
 	return nil
 }
 
-func GetUserActivity(userID string) (*UserActivity, error) {
-	// Get user activity from DynamoDB
-	pk := UserActivityPK(userID)
-	sk := UserActivitySK(userID)
-	av, err := client.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: &userActivityTableName,
-		Key: map[string]types.AttributeValue{
-			"_pk": &types.AttributeValueMemberS{Value: pk},
-			"_sk": &types.AttributeValueMemberS{Value: sk},
-		},
-	})
+// ReleaseLease deletes the lease if it is still held by its owner
+func ReleaseLease(lease *Lease) error {
+	return store.DeleteLease(ctx, lease.Name, lease.Owner)
+}
+
+// GetUserActivity gets the user activity for the user. A new record is created if none exists, and expired records
+// are refreshed from Genesys.
+func GetUserActivity(ctx context.Context, gc genesys.Client, userID string) (*UserActivity, error) {
+	ua, err := ReadUserActivity(userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get UserActivity from DynamoDB: %v", err)
+		return nil, err
 	}
 
 	// Create a new UserActivity object if it doesn't exist
-	if av == nil || len(av.Item) == 0 {
+	if ua == nil {
 		fmt.Printf("User activity not found for %s, creating new record\n", userID)
-		return CreateUserActivity(userID), nil
-	}
-
-	// Unmarshal the DB record into a UserActivityEntity object
-	var ua UserActivityEntity
-	err = attributevalue.UnmarshalMap(av.Item, &ua)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal UserActivity from DynamoDB: %v", err)
+		return CreateUserActivity(ctx, gc, userID), nil
 	}
 
 	// Refresh expired records
-	if ua.UserActivity.InactivityTTL != nil && *ua.UserActivity.InactivityTTL < time.Now().UnixMilli() {
-		ua.UserActivity.RefreshUser()
+	if ua.InactivityTTL != nil && *ua.InactivityTTL < time.Now().UnixMilli() {
+		ua.RefreshUser(ctx, gc)
 	}
 
-	// Return the unpacked UserActivity object
-	return &ua.UserActivity, nil
+	return ua, nil
 }
 
-func ListUserActivity(pending bool, beforeTime *int64) ([]UserActivity, error) {
-	status := "pending"
-	if !pending {
-		status = "exempt"
+// ReadUserActivity reads the stored user activity for the user, or returns nil if there is none
+func ReadUserActivity(userID string) (*UserActivity, error) {
+	entity, err := store.GetUserActivity(ctx, userID)
+	if err != nil || entity == nil {
+		return nil, err
 	}
+	entity.UserActivity.markPersisted()
 
-	// Define query conditions
-	keyCondition := expression.Key("_gsi_list_pk").Equal(expression.Value(fmt.Sprintf("%s|%s", userActivityPrefix, status)))
+	// Return the unpacked UserActivity object
+	return &entity.UserActivity, nil
+}
 
-	// Add sort key condition if beforeTime is provided
+// ListUserActivity lists the user activity records with the status, optionally only those due before beforeTime
+func ListUserActivity(status string, beforeTime *int64) ([]UserActivity, error) {
+	var beforeSK *string
 	if beforeTime != nil {
-		keyCondition = expression.KeyAnd(keyCondition, expression.Key("_gsi_list_sk").LessThan(expression.Value(fmt.Sprintf("%d", *beforeTime))))
+		beforeSK = &[]string{fmt.Sprintf("%d", *beforeTime)}[0]
 	}
 
-	expr, err := expression.NewBuilder().WithKeyCondition(keyCondition).Build()
+	entities, err := store.QueryUserActivity(ctx, UserActivityListGSIPK(status), beforeSK)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build expression: %v", err)
+		return nil, err
 	}
 
-	// Query the GSI to get all items with the specified status
-	query := &dynamodb.QueryInput{
-		TableName:                 &userActivityTableName,
-		IndexName:                 aws.String(userActivityListGSI),
-		KeyConditionExpression:    expr.KeyCondition(),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
+	uaList := make([]UserActivity, len(entities))
+	for i, entity := range entities {
+		entity.UserActivity.markPersisted()
+		uaList[i] = entity.UserActivity
 	}
+	return uaList, nil
+}
 
-	// Collect all results across all pages
-	var uaList []UserActivity
-	var lastEvaluatedKey map[string]types.AttributeValue
+// ListUserActivityPage lists up to limit user activity records with the status, starting after the cursor returned with
+// the previous page (or at the start if it is empty). The returned cursor is empty after the last page.
+func ListUserActivityPage(status string, cursor string, limit int) ([]UserActivity, string, error) {
+	entities, next, err := store.QueryUserActivityPage(ctx, UserActivityListGSIPK(status), cursor, int32(limit))
+	if err != nil {
+		return nil, "", err
+	}
 
-	for {
-		// Set the exclusive start key for pagination
-		if lastEvaluatedKey != nil {
-			query.ExclusiveStartKey = lastEvaluatedKey
-		}
+	uaList := make([]UserActivity, len(entities))
+	for i, entity := range entities {
+		entity.UserActivity.markPersisted()
+		uaList[i] = entity.UserActivity
+	}
+	return uaList, next, nil
+}
 
-		result, err := client.Query(ctx, query)
-		if err != nil {
-			return nil, fmt.Errorf("failed to query UserActivity from DynamoDB: %v", err)
-		}
+// ReadCursor reads the named cursor, or returns nil if there is none
+func ReadCursor(name string) (*Cursor, error) {
+	entity, err := store.GetCursor(ctx, name)
+	if err != nil || entity == nil {
+		return nil, err
+	}
+	return &entity.Cursor, nil
+}
 
-		// Process items from this page
-		for _, item := range result.Items {
-			var ua UserActivityEntity
-			err := attributevalue.UnmarshalMap(item, &ua)
-			if err != nil {
-				fmt.Printf("Warning: failed to unmarshal item: %v\n", err)
-				continue
-			}
-			uaList = append(uaList, ua.UserActivity)
-		}
+// WriteCursor writes the cursor
+func WriteCursor(c Cursor) error {
+	c.UpdatedAt = time.Now().UnixMilli()
+	return store.PutCursor(ctx, c.Entity())
+}
 
-		// Check if there are more pages
-		if result.LastEvaluatedKey == nil {
-			break
-		}
-		lastEvaluatedKey = result.LastEvaluatedKey
+// WriteReaperEvent writes a ReaperEvent object to the user activity table
+func WriteReaperEvent(re ReaperEvent) error {
+	return store.PutReaperEvent(ctx, re.Entity())
+}
+
+// ListReaperEvents lists the reaper events with the action, newest first, that happened after sinceTime
+func ListReaperEvents(action string, sinceTime int64) ([]ReaperEvent, error) {
+	entities, err := store.QueryReaperEvents(ctx, ReaperEventListGSIPK(action), fmt.Sprintf("%d", sinceTime))
+	if err != nil {
+		return nil, err
 	}
 
-	return uaList, nil
+	reList := make([]ReaperEvent, len(entities))
+	for i, entity := range entities {
+		reList[i] = entity.ReaperEvent
+	}
+	return reList, nil
 }
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MemoryStore keeps the items in memory; it is intended for tests and local runs. Items are marshalled like they are
+// for DynamoDB, so the dynamodbav tags are applied and the records read are copies.
+type MemoryStore struct {
+	mu    sync.Mutex
+	items map[string]map[string]types.AttributeValue
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items: make(map[string]map[string]types.AttributeValue),
+	}
+}
+
+func (s *MemoryStore) GetUserActivity(ctx context.Context, userID string) (*UserActivityEntity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[itemKey(UserActivityPK(userID), UserActivitySK(userID))]
+	if !ok {
+		return nil, nil
+	}
+
+	var entity UserActivityEntity
+	if err := attributevalue.UnmarshalMap(item, &entity); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal UserActivity: %v", err)
+	}
+	return &entity, nil
+}
+
+func (s *MemoryStore) PutUserActivity(ctx context.Context, entity UserActivityEntity, expectedVersion *int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := itemKey(entity.PartitionKey, entity.SortKey)
+	item, exists := s.items[key]
+	if expectedVersion == nil && exists {
+		return conflictError(entity.UserID, expectedVersion)
+	}
+	if expectedVersion != nil {
+		var stored UserActivityEntity
+		if !exists {
+			return conflictError(entity.UserID, expectedVersion)
+		}
+		if err := attributevalue.UnmarshalMap(item, &stored); err != nil {
+			return fmt.Errorf("failed to unmarshal UserActivity: %v", err)
+		}
+		if stored.Version != *expectedVersion {
+			return conflictError(entity.UserID, expectedVersion)
+		}
+	}
+
+	return s.put(key, entity)
+}
+
+func (s *MemoryStore) QueryUserActivity(ctx context.Context, listPK string, beforeSK *string) ([]UserActivityEntity, error) {
+	var entities []UserActivityEntity
+	err := s.query(listPK, func(listSK string) bool { return beforeSK == nil || listSK < *beforeSK }, &entities)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entities, func(i, j int) bool { return entities[i].ListItemGSISK < entities[j].ListItemGSISK })
+	return entities, nil
+}
+
+func (s *MemoryStore) QueryUserActivityPage(ctx context.Context, listPK string, cursor string, limit int32) ([]UserActivityEntity, string, error) {
+	var entities []UserActivityEntity
+	if err := s.query(listPK, func(listSK string) bool { return true }, &entities); err != nil {
+		return nil, "", err
+	}
+	sort.SliceStable(entities, func(i, j int) bool { return pageKey(entities[i]).before(pageKey(entities[j])) })
+
+	// The cursor is the JSON of the list GSI sort key and the primary key of the last record returned
+	if cursor != "" {
+		var after userActivityPageKey
+		if err := json.Unmarshal([]byte(cursor), &after); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %v", err)
+		}
+		i := sort.Search(len(entities), func(i int) bool { return after.before(pageKey(entities[i])) })
+		entities = entities[i:]
+	}
+	if len(entities) <= int(limit) {
+		return entities, "", nil
+	}
+
+	entities = entities[:limit]
+	next, err := json.Marshal(pageKey(entities[len(entities)-1]))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal cursor: %v", err)
+	}
+	return entities, string(next), nil
+}
+
+// userActivityPageKey orders the user activity of a list page
+type userActivityPageKey struct {
+	ListSK string `json:"listSk"`
+	Key    string `json:"key"`
+}
+
+func pageKey(entity UserActivityEntity) userActivityPageKey {
+	return userActivityPageKey{ListSK: entity.ListItemGSISK, Key: itemKey(entity.PartitionKey, entity.SortKey)}
+}
+
+func (k userActivityPageKey) before(other userActivityPageKey) bool {
+	return k.ListSK < other.ListSK || (k.ListSK == other.ListSK && k.Key < other.Key)
+}
+
+func (s *MemoryStore) PutReaperEvent(ctx context.Context, entity ReaperEventEntity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(itemKey(entity.PartitionKey, entity.SortKey), entity)
+}
+
+func (s *MemoryStore) QueryReaperEvents(ctx context.Context, listPK string, sinceSK string) ([]ReaperEventEntity, error) {
+	var entities []ReaperEventEntity
+	err := s.query(listPK, func(listSK string) bool { return listSK > sinceSK }, &entities)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entities, func(i, j int) bool { return entities[i].ListItemGSISK > entities[j].ListItemGSISK })
+	return entities, nil
+}
+
+func (s *MemoryStore) PutLease(ctx context.Context, entity LeaseEntity, acquire bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := itemKey(entity.PartitionKey, entity.SortKey)
+	held, exists, err := s.lease(key)
+	if err != nil {
+		return err
+	}
+	free := !exists || held.ExpiresAt < entity.HeartbeatAt
+	if held.Owner != entity.Owner && !(acquire && free) {
+		return &LeaseHeldError{Name: entity.Name, Owner: held.Owner, ExpiresAt: held.ExpiresAt}
+	}
+
+	return s.put(key, entity)
+}
+
+func (s *MemoryStore) DeleteLease(ctx context.Context, name string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := itemKey(LeasePK(name), LeasePK(name))
+	held, exists, err := s.lease(key)
+	if err != nil {
+		return err
+	}
+	if exists && held.Owner == owner {
+		delete(s.items, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetCursor(ctx context.Context, name string) (*CursorEntity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[itemKey(CursorPK(name), CursorPK(name))]
+	if !ok {
+		return nil, nil
+	}
+
+	var entity CursorEntity
+	if err := attributevalue.UnmarshalMap(item, &entity); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal Cursor: %v", err)
+	}
+	return &entity, nil
+}
+
+func (s *MemoryStore) PutCursor(ctx context.Context, entity CursorEntity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(itemKey(entity.PartitionKey, entity.SortKey), entity)
+}
+
+// lease returns the stored lease item
+func (s *MemoryStore) lease(key string) (LeaseEntity, bool, error) {
+	var held LeaseEntity
+	item, ok := s.items[key]
+	if !ok {
+		return held, false, nil
+	}
+	if err := attributevalue.UnmarshalMap(item, &held); err != nil {
+		return held, false, fmt.Errorf("failed to unmarshal Lease: %v", err)
+	}
+	return held, true, nil
+}
+
+// put marshals and stores the entity; the caller holds the lock
+func (s *MemoryStore) put(key string, entity interface{}) error {
+	item, err := attributevalue.MarshalMap(entity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal item: %v", err)
+	}
+	s.items[key] = item
+	return nil
+}
+
+// query unmarshals the items on the list GSI with the partition key whose sort key matches into entities
+func (s *MemoryStore) query(listPK string, match func(listSK string) bool, entities interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var items []map[string]types.AttributeValue
+	for _, item := range s.items {
+		var keys singleTableEntityListGSI
+		if err := attributevalue.UnmarshalMap(item, &keys); err != nil {
+			return fmt.Errorf("failed to unmarshal item: %v", err)
+		}
+		if keys.ListItemGSIPK == listPK && match(keys.ListItemGSISK) {
+			items = append(items, item)
+		}
+	}
+
+	if err := attributevalue.UnmarshalListOfMaps(items, entities); err != nil {
+		return fmt.Errorf("failed to unmarshal items: %v", err)
+	}
+	return nil
+}
+
+func itemKey(pk string, sk string) string {
+	return pk + "|" + sk
+}
@@ -0,0 +1,53 @@
+package db
+
+import "context"
+
+/**
+ * Storage backends
+ *
+ * The package functions read and write the items of the user activity table through a Store, which the lambda
+ * functions set in main(). Importing the package does not connect to AWS: DynamoDBStore loads the AWS config on first
+ * use, and MemoryStore keeps the items in memory so that the lambda handlers can be run offline, e.g. in tests with
+ * genesys.FakeClient and scheduler.MemoryScheduler.
+ */
+
+// Store reads and writes the items of the user activity table
+type Store interface {
+	// GetUserActivity returns the stored user activity of the user, or nil if there is none
+	GetUserActivity(ctx context.Context, userID string) (*UserActivityEntity, error)
+	// PutUserActivity writes the user activity if the stored record has the expected version, or if there is no stored
+	// record when expectedVersion is nil. A *ConflictError is returned otherwise.
+	PutUserActivity(ctx context.Context, entity UserActivityEntity, expectedVersion *int64) error
+	// QueryUserActivity returns the user activity with the list GSI partition key, ordered by the list GSI sort key and
+	// optionally only those before beforeSK
+	QueryUserActivity(ctx context.Context, listPK string, beforeSK *string) ([]UserActivityEntity, error)
+	// QueryUserActivityPage returns up to limit user activity with the list GSI partition key, ordered by the list GSI
+	// sort key and starting after the cursor returned with the previous page. The cursor is empty after the last page.
+	QueryUserActivityPage(ctx context.Context, listPK string, cursor string, limit int32) ([]UserActivityEntity, string, error)
+	PutReaperEvent(ctx context.Context, entity ReaperEventEntity) error
+	// QueryReaperEvents returns the reaper events with the list GSI partition key and a sort key after sinceSK, newest
+	// first
+	QueryReaperEvents(ctx context.Context, listPK string, sinceSK string) ([]ReaperEventEntity, error)
+	// PutLease writes the lease if it is held by the same owner. To acquire the lease, it is also written if there is
+	// none or it has expired. A *LeaseHeldError is returned otherwise.
+	PutLease(ctx context.Context, entity LeaseEntity, acquire bool) error
+	// DeleteLease deletes the lease if it is still held by the owner
+	DeleteLease(ctx context.Context, name string, owner string) error
+	// GetCursor returns the named cursor, or nil if there is none
+	GetCursor(ctx context.Context, name string) (*CursorEntity, error)
+	PutCursor(ctx context.Context, entity CursorEntity) error
+}
+
+// SetStore sets the backend the records are read from and written to
+func SetStore(s Store) {
+	store = s
+}
+
+// conflictError returns the error for a user activity write whose expected version didn't match
+func conflictError(userID string, expectedVersion *int64) *ConflictError {
+	var version int64
+	if expectedVersion != nil {
+		version = *expectedVersion
+	}
+	return &ConflictError{UserID: userID, Version: version}
+}
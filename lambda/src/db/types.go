@@ -1,7 +1,11 @@
 package db
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 	"user-activity-monitor/src/apitypes"
@@ -16,13 +20,41 @@ import (
 
 const (
 	userActivityPrefix = "ua"
+	reaperEventPrefix  = "re"
+	leasePrefix        = "lease"
+	cursorPrefix       = "cursor"
 )
 
+// minTTLDelay is the shortest time an inactivity TTL is set in the future, so the record is written as pending
+const minTTLDelay = 5 * time.Second
+
+// User activity list statuses
+const (
+	StatusPending = "pending"
+	StatusExempt  = "exempt"
+	// StatusFailed is used for users whose logout failed too many times; the reaper no longer retries them
+	StatusFailed = "failed"
+)
+
+// Reaper event actions
+const (
+	// ReaperEventDryRun records a logout that was not performed because the reaper is in dry-run mode
+	ReaperEventDryRun = "dryrun"
+	// ReaperEventSkipped records a logout that was skipped because the live Genesys state showed the user is active
+	ReaperEventSkipped = "skipped"
+	// ReaperEventEnforced records the enforcement action taken on an inactive user
+	ReaperEventEnforced = "enforced"
+)
+
+// ReaperEventActions lists every reaper event action
+var ReaperEventActions = []string{ReaperEventDryRun, ReaperEventSkipped, ReaperEventEnforced}
+
 // singleTableEntity provides the PK and SK for a single table entity
 type singleTableEntity struct {
 	PartitionKey string `json:"_pk" dynamodbav:"_pk"`
 	SortKey      string `json:"_sk" dynamodbav:"_sk"`
-	TTL          *int64 `json:"_ttl,omitempty" dynamodbav:"_ttl,omitempty"`
+	// TTL is when DynamoDB deletes the item, in epoch seconds (the only unit DynamoDB TTL honours)
+	TTL *int64 `json:"_ttl,omitempty" dynamodbav:"_ttl,omitempty"`
 }
 
 type singleTableEntityListGSI struct {
@@ -38,7 +70,119 @@ type UserActivity struct {
 	Conversing          bool   `json:"conversing" dynamodbav:"conversing"`
 	GroupID             string `json:"groupId" dynamodbav:"groupId"`
 	InactivityTTL       *int64 `json:"inactivityTTL" dynamodbav:"inactivityTTL"`
+	WarnedAt            *int64 `json:"warnedAt" dynamodbav:"warnedAt"`
+	LogoutAttempts      int    `json:"logoutAttempts" dynamodbav:"logoutAttempts"`
+	LastLogoutError     string `json:"lastLogoutError" dynamodbav:"lastLogoutError"`
+	NextLogoutRetry     *int64 `json:"nextLogoutRetry" dynamodbav:"nextLogoutRetry"`
+	LogoutFailedAt      *int64 `json:"logoutFailedAt" dynamodbav:"logoutFailedAt"`
 	LastUpdated         int64  `json:"lastUpdated" dynamodbav:"lastUpdated"`
+
+	// Conversations are the non-zero conversation counters per channel from the last conversation summary, and
+	// ConversingChannels the channels on which they count as conversing under the timeout group's conversing rules
+	Conversations      map[string]ChannelConversations `json:"conversations" dynamodbav:"conversations,omitempty"`
+	ConversingChannels []string                        `json:"conversingChannels" dynamodbav:"conversingChannels,omitempty"`
+
+	// ACWSince is when the user started conversing only through after-call work. ACWDeadline is when the timeout
+	// group's ACW policy is due, and ACWEnforcedAt when its action was taken (it is taken once per ACW period).
+	ACWSince      *int64 `json:"acwSince" dynamodbav:"acwSince"`
+	ACWDeadline   *int64 `json:"acwDeadline" dynamodbav:"acwDeadline"`
+	ACWEnforcedAt *int64 `json:"acwEnforcedAt" dynamodbav:"acwEnforcedAt"`
+
+	// SessionStartedAt is when the user came online after being offline. SessionDeadline is when the timeout group's
+	// max session length is reached (or the deferred logout is due), and SessionEnforcedAt when the user was logged out
+	// for it.
+	SessionStartedAt  *int64 `json:"sessionStartedAt" dynamodbav:"sessionStartedAt"`
+	SessionDeadline   *int64 `json:"sessionDeadline" dynamodbav:"sessionDeadline"`
+	SessionEnforcedAt *int64 `json:"sessionEnforcedAt" dynamodbav:"sessionEnforcedAt"`
+
+	// RoutingStatus is the user's last known routing status, NotRespondingSince when it became NOT_RESPONDING.
+	// StationID is the station associated with the user, NoStationSince when the user was last seen without one.
+	RoutingStatus      string `json:"routingStatus" dynamodbav:"routingStatus"`
+	NotRespondingSince *int64 `json:"notRespondingSince" dynamodbav:"notRespondingSince"`
+	StationID          string `json:"stationId" dynamodbav:"stationId"`
+	NoStationSince     *int64 `json:"noStationSince" dynamodbav:"noStationSince"`
+	// Condition is the inactivity condition the inactivity TTL was armed for, if any
+	Condition string `json:"condition" dynamodbav:"condition"`
+
+	// LadderStep is the index of the escalation ladder step the reaper applies next. NextStepAt is its deadline once
+	// the first step was applied (before that, the inactivity TTL is the deadline).
+	LadderStep int    `json:"ladderStep" dynamodbav:"ladderStep"`
+	NextStepAt *int64 `json:"nextStepAt" dynamodbav:"nextStepAt"`
+	// EnforcedPresence is the system presence set by the last ladder step; being in it is not treated as activity
+	EnforcedPresence string `json:"enforcedPresence" dynamodbav:"enforcedPresence"`
+
+	// InactiveSince is when the inactivity TTL started counting. ScheduleBoundary is set when the TTL was capped at a
+	// business-hours schedule boundary, where the reaper re-evaluates the timeout instead of enforcing it.
+	InactiveSince    *int64 `json:"inactiveSince" dynamodbav:"inactiveSince"`
+	ScheduleBoundary bool   `json:"scheduleBoundary" dynamodbav:"scheduleBoundary"`
+
+	// Source timestamps and IDs of the last applied events, used to drop stale and duplicate events
+	PresenceUpdatedAt      int64  `json:"presenceUpdatedAt" dynamodbav:"presenceUpdatedAt"`
+	PresenceEventID        string `json:"presenceEventId" dynamodbav:"presenceEventId"`
+	ConversationsUpdatedAt int64  `json:"conversationsUpdatedAt" dynamodbav:"conversationsUpdatedAt"`
+	ConversationsEventID   string `json:"conversationsEventId" dynamodbav:"conversationsEventId"`
+	RoutingStatusUpdatedAt int64  `json:"routingStatusUpdatedAt" dynamodbav:"routingStatusUpdatedAt"`
+	RoutingStatusEventID   string `json:"routingStatusEventId" dynamodbav:"routingStatusEventId"`
+	StationUpdatedAt       int64  `json:"stationUpdatedAt" dynamodbav:"stationUpdatedAt"`
+	StationEventID         string `json:"stationEventId" dynamodbav:"stationEventId"`
+
+	// The reaper invocation processing the record, so that no other invocation acts on it until the claim expires
+	ClaimedBy      string `json:"claimedBy" dynamodbav:"claimedBy"`
+	ClaimExpiresAt *int64 `json:"claimExpiresAt" dynamodbav:"claimExpiresAt"`
+
+	// Version is incremented on every write and used for optimistic concurrency
+	Version int64 `json:"version" dynamodbav:"version"`
+
+	// persisted is set when the record was read from the DB, with the due time it was read with
+	persisted   bool
+	storedDueAt *int64
+}
+
+// ChannelConversations are the conversation counters of a channel
+type ChannelConversations struct {
+	ContactCenterActive int `json:"contactCenterActive" dynamodbav:"contactCenterActive"`
+	ContactCenterACW    int `json:"contactCenterAcw" dynamodbav:"contactCenterAcw"`
+	EnterpriseActive    int `json:"enterpriseActive" dynamodbav:"enterpriseActive"`
+	EnterpriseACW       int `json:"enterpriseAcw" dynamodbav:"enterpriseAcw"`
+}
+
+// Count returns the value of a groupconfig conversation counter
+func (c ChannelConversations) Count(counter string) int {
+	switch counter {
+	case groupconfig.CounterContactCenterActive:
+		return c.ContactCenterActive
+	case groupconfig.CounterContactCenterACW:
+		return c.ContactCenterACW
+	case groupconfig.CounterEnterpriseActive:
+		return c.EnterpriseActive
+	case groupconfig.CounterEnterpriseACW:
+		return c.EnterpriseACW
+	}
+	return 0
+}
+
+// markPersisted records that the UserActivity object was read from the DB in its current state
+func (ua *UserActivity) markPersisted() {
+	ua.persisted = true
+	ua.storedDueAt = ua.scheduledDueAt()
+}
+
+// scheduledDueAt returns the due time the user's reap schedule should have, or nil if it should have none
+func (ua UserActivity) scheduledDueAt() *int64 {
+	if ua.Status() != StatusPending {
+		return nil
+	}
+	return ua.DueAt()
+}
+
+// ConflictError is returned when a UserActivity record was updated after it was read
+type ConflictError struct {
+	UserID  string
+	Version int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("user activity for %s was updated after version %d was read", e.UserID, e.Version)
 }
 
 // UserActivityEntity is an aggregate type for the DB record for a UserActivity object
@@ -56,21 +200,16 @@ func UserActivitySK(userID string) string {
 	return fmt.Sprintf("%s|%s", userActivityPrefix, userID)
 }
 
-func UserActivityListGSIPK(inactivityTTL *int64) string {
-	status := "pending"
-	if inactivityTTL == nil || *inactivityTTL < time.Now().UnixMilli() {
-		status = "exempt"
-	}
-
+func UserActivityListGSIPK(status string) string {
 	return strings.ToLower(fmt.Sprintf("%s|%s", userActivityPrefix, status))
 }
 
-func UserActivityListGSISK(inactivityTTL *int64) string {
-	if inactivityTTL == nil {
+func UserActivityListGSISK(dueAt *int64) string {
+	if dueAt == nil {
 		return "0"
 	}
 
-	return fmt.Sprintf("%v", *inactivityTTL)
+	return fmt.Sprintf("%v", *dueAt)
 }
 
 func (ua UserActivity) PK() string {
@@ -82,11 +221,124 @@ func (ua UserActivity) SK() string {
 }
 
 func (ua UserActivity) ListGSIPK() string {
-	return UserActivityListGSIPK(ua.InactivityTTL)
+	return UserActivityListGSIPK(ua.Status())
+}
+
+// Status returns the list status of the user activity
+func (ua UserActivity) Status() string {
+	if ua.LogoutFailedAt != nil {
+		return StatusFailed
+	}
+	if ua.NextLogoutRetry != nil || ua.NextStepAt != nil || ua.ACWDeadline != nil || ua.SessionDeadline != nil {
+		return StatusPending
+	}
+	if ua.InactivityTTL == nil || *ua.InactivityTTL < time.Now().UnixMilli() {
+		return StatusExempt
+	}
+	return StatusPending
 }
 
 func (ua UserActivity) ListGSISK() string {
-	return UserActivityListGSISK(ua.InactivityTTL)
+	return UserActivityListGSISK(ua.DueAt())
+}
+
+// DueAt returns the time the reaper needs to act on the user: the next retry time if a logout failed, otherwise the
+// session deadline if it comes first
+func (ua UserActivity) DueAt() *int64 {
+	if ua.NextLogoutRetry != nil {
+		return ua.NextLogoutRetry
+	}
+	dueAt := ua.inactivityDueAt()
+	if ua.SessionDeadline != nil && (dueAt == nil || *ua.SessionDeadline < *dueAt) {
+		return ua.SessionDeadline
+	}
+	return dueAt
+}
+
+// inactivityDueAt returns the ACW policy deadline, the next ladder step deadline once the first step was applied, the
+// warning time if the user has not been warned yet, otherwise the inactivity TTL
+func (ua UserActivity) inactivityDueAt() *int64 {
+	if ua.ACWDeadline != nil {
+		return ua.ACWDeadline
+	}
+	if ua.NextStepAt != nil {
+		return ua.NextStepAt
+	}
+	if ua.InactivityTTL == nil || !ua.NeedsWarning() {
+		return ua.InactivityTTL
+	}
+
+	group, _ := groupconfig.GetTimeoutGroup(ua.GroupID)
+	return &[]int64{*ua.InactivityTTL - (time.Duration(group.WarningMinutes) * time.Minute).Milliseconds()}[0]
+}
+
+// IsDue checks if the reaper needs to act on the user at the time
+func (ua UserActivity) IsDue(now int64) bool {
+	dueAt := ua.DueAt()
+	return ua.LogoutFailedAt == nil && dueAt != nil && *dueAt < now
+}
+
+// IsSessionDue checks if the user's session has reached the max session length of their timeout group at the time
+func (ua UserActivity) IsSessionDue(now int64) bool {
+	return ua.SessionDeadline != nil && *ua.SessionDeadline < now
+}
+
+// NeedsWarning checks if the user's timeout group warns before the first enforcement step and the user has not been
+// warned yet
+func (ua UserActivity) NeedsWarning() bool {
+	group, ok := groupconfig.GetTimeoutGroup(ua.GroupID)
+	return ok && group.WarningMinutes > 0 && ua.WarnedAt == nil && ua.LadderStep == 0 && !ua.ScheduleBoundary
+}
+
+// CurrentStep returns the escalation ladder step the reaper applies next
+func (ua UserActivity) CurrentStep() groupconfig.Step {
+	group, _ := groupconfig.GetTimeoutGroup(ua.GroupID)
+	ladder := group.Ladder()
+	if ua.LadderStep >= len(ladder) {
+		// The ladder was shortened since the step was reached
+		return ladder[len(ladder)-1]
+	}
+	return ladder[ua.LadderStep]
+}
+
+// CompleteStep records that the current ladder step was applied, and moves the user to the next step. The next step
+// is due its afterMinutes after the user became inactive, whatever set the first step's deadline (a presence override,
+// the business-hours schedule or an inactivity condition), and no earlier than right away. After the last step, the
+// inactivity TTL is cleared. enforcedPresence is the system presence the step set, if any.
+func (ua *UserActivity) CompleteStep(enforcedPresence string) {
+	group, _ := groupconfig.GetTimeoutGroup(ua.GroupID)
+	ladder := group.Ladder()
+	next := ua.LadderStep + 1
+	if next >= len(ladder) || ua.InactivityTTL == nil {
+		ua.ClearInactivityTTL()
+		return
+	}
+
+	var inactiveSince time.Time
+	if ua.InactiveSince != nil {
+		inactiveSince = time.UnixMilli(*ua.InactiveSince)
+	} else {
+		// Records armed before the start of the inactivity was stored: the inactivity TTL is the deadline of the first
+		// step
+		inactiveSince = time.UnixMilli(*ua.InactivityTTL).Add(-time.Duration(ladder[0].AfterMinutes) * time.Minute)
+	}
+	nextStepAt := inactiveSince.Add(time.Duration(ladder[next].AfterMinutes) * time.Minute)
+	if now := time.Now(); nextStepAt.Before(now.Add(minTTLDelay)) {
+		nextStepAt = now.Add(minTTLDelay)
+	}
+	ua.LadderStep = next
+	ua.NextStepAt = &[]int64{nextStepAt.UnixMilli()}[0]
+	ua.EnforcedPresence = enforcedPresence
+	ua.LogoutAttempts = 0
+	ua.LastLogoutError = ""
+	ua.NextLogoutRetry = nil
+	ua.ReleaseClaim()
+}
+
+// InEnforcedState checks if the user is still in the presence a ladder step put them in, without any conversation
+func (ua UserActivity) InEnforcedState() bool {
+	return ua.LadderStep > 0 && ua.EnforcedPresence != "" && strings.EqualFold(ua.Presence, ua.EnforcedPresence) &&
+		!ua.Conversing
 }
 
 // Entity creates a DB entity from the UserActivity object
@@ -95,7 +347,7 @@ func (ua UserActivity) Entity() UserActivityEntity {
 		singleTableEntity: singleTableEntity{
 			PartitionKey: ua.PK(),
 			SortKey:      ua.SK(),
-			TTL:          &[]int64{time.Now().AddDate(0, 1, 0).UnixMilli()}[0],
+			TTL:          &[]int64{time.Now().AddDate(0, 1, 0).Unix()}[0],
 		},
 		singleTableEntityListGSI: singleTableEntityListGSI{
 			ListItemGSIPK: ua.ListGSIPK(),
@@ -105,100 +357,744 @@ func (ua UserActivity) Entity() UserActivityEntity {
 	}
 }
 
-// SetInactivityTTL sets the inactivity TTL to the current time plus the duration
+// SetInactivityTTL sets the inactivity TTL to the current time plus the duration and resets the reaper state
 func (ua *UserActivity) SetInactivityTTL(duration time.Duration) {
-	ua.InactivityTTL = &[]int64{time.Now().Add(duration).UnixMilli()}[0]
+	now := time.Now()
+	ua.InactivityTTL = &[]int64{now.Add(duration).UnixMilli()}[0]
+	ua.InactiveSince = &[]int64{now.UnixMilli()}[0]
+	ua.ScheduleBoundary = false
+	ua.Condition = ""
+	ua.resetReaperState()
 }
 
-// ClearInactivityTTL clears the inactivity TTL
+// ClearInactivityTTL clears the inactivity TTL and resets the reaper state
 func (ua *UserActivity) ClearInactivityTTL() {
 	ua.InactivityTTL = nil
+	ua.InactiveSince = nil
+	ua.ScheduleBoundary = false
+	ua.Condition = ""
+	ua.resetReaperState()
 }
 
-// RefreshInactivityTTL refreshes the inactivity TTL based on the assigned timeout group
-func (ua *UserActivity) RefreshInactivityTTL() {
-	if ua.GroupID == "" {
+// armInactivityTTL sets the inactivity TTL from the effective timeout of the user's timeout group at the time, counting
+// the user as inactive since inactiveSince. If the schedule changes before the TTL, the TTL is capped at the boundary
+// so the timeout is re-evaluated there. Users exempt outside business hours start counting at the next boundary.
+func (ua *UserActivity) armInactivityTTL(inactiveSince time.Time, now time.Time) {
+	group, ok := groupconfig.GetTimeoutGroup(ua.GroupID)
+	minutes, exempt, boundary := group.EffectiveTimeout(ua.SecondaryPresenceID, now)
+	if !ok || (exempt && boundary.IsZero()) {
 		ua.ClearInactivityTTL()
-	} else {
-		ua.SetInactivityTTL(time.Duration(groupconfig.TimeoutGroups[ua.GroupID].TimeoutMinutes) * time.Minute)
+		return
 	}
+
+	ttl := inactiveSince.Add(time.Duration(minutes) * time.Minute)
+	if exempt {
+		inactiveSince = boundary
+		ttl = boundary
+	}
+	capped := exempt
+	if !boundary.IsZero() && ttl.After(boundary) {
+		ttl = boundary
+		capped = true
+	}
+	if ttl.Before(now.Add(minTTLDelay)) {
+		// Keep the TTL in the future so the record is listed as pending
+		ttl = now.Add(minTTLDelay)
+	}
+
+	ua.resetReaperState()
+	ua.InactivityTTL = &[]int64{ttl.UnixMilli()}[0]
+	ua.InactiveSince = &[]int64{inactiveSince.UnixMilli()}[0]
+	ua.ScheduleBoundary = capped
+	ua.Condition = ""
+}
+
+// ReevaluateSchedule re-arms the inactivity TTL at a schedule boundary with the timeout that applies from now on,
+// keeping the time the user has already been inactive. A user who has been inactive for longer than the new timeout is
+// due right away.
+func (ua *UserActivity) ReevaluateSchedule() {
+	now := time.Now()
+	inactiveSince := now
+	if ua.InactiveSince != nil && *ua.InactiveSince < now.UnixMilli() {
+		inactiveSince = time.UnixMilli(*ua.InactiveSince)
+	}
+	ua.armInactivityTTL(inactiveSince, now)
+}
+
+// resetReaperState clears the warning, logout attempts, escalation ladder and reaper claim
+func (ua *UserActivity) resetReaperState() {
+	ua.WarnedAt = nil
+	ua.LadderStep = 0
+	ua.NextStepAt = nil
+	ua.EnforcedPresence = ""
+	ua.LogoutAttempts = 0
+	ua.LastLogoutError = ""
+	ua.NextLogoutRetry = nil
+	ua.LogoutFailedAt = nil
+	ua.ReleaseClaim()
+}
+
+// Claim marks the record as processed by the reaper invocation until the time (in milliseconds)
+func (ua *UserActivity) Claim(owner string, until int64) {
+	ua.ClaimedBy = owner
+	ua.ClaimExpiresAt = &until
+}
+
+// ReleaseClaim clears the reaper claim
+func (ua *UserActivity) ReleaseClaim() {
+	ua.ClaimedBy = ""
+	ua.ClaimExpiresAt = nil
+}
+
+// IsClaimedByOther checks if another reaper invocation holds an unexpired claim on the record
+func (ua UserActivity) IsClaimedByOther(owner string, now int64) bool {
+	return ua.ClaimedBy != "" && ua.ClaimedBy != owner && ua.ClaimExpiresAt != nil && *ua.ClaimExpiresAt > now
+}
+
+// RecordLogoutFailure records a failed logout attempt. The next attempt is scheduled with exponential backoff starting
+// at retryDelay, until maxAttempts is reached and the user is moved to the failed status.
+func (ua *UserActivity) RecordLogoutFailure(err error, maxAttempts int, retryDelay time.Duration, maxRetryDelay time.Duration) {
+	now := time.Now()
+	ua.LogoutAttempts++
+	ua.LastLogoutError = err.Error()
+
+	if ua.LogoutAttempts >= maxAttempts {
+		ua.NextLogoutRetry = nil
+		ua.LogoutFailedAt = &[]int64{now.UnixMilli()}[0]
+		return
+	}
+
+	delay := retryDelay << (ua.LogoutAttempts - 1)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	ua.NextLogoutRetry = &[]int64{now.Add(delay).UnixMilli()}[0]
+}
+
+// MarkWarned records that the user has been warned. If the TTL would end before the group's grace period, it is
+// extended so the user always gets the full grace period after the warning.
+func (ua *UserActivity) MarkWarned() {
+	now := time.Now()
+	if group, ok := groupconfig.GetTimeoutGroup(ua.GroupID); ok {
+		graceEnd := now.Add(time.Duration(group.WarningMinutes) * time.Minute).UnixMilli()
+		if ua.InactivityTTL == nil || *ua.InactivityTTL < graceEnd {
+			ua.InactivityTTL = &graceEnd
+		}
+	}
+	ua.WarnedAt = &[]int64{now.UnixMilli()}[0]
+}
+
+// RefreshInactivityTTL refreshes the inactivity TTL based on the assigned timeout group
+func (ua *UserActivity) RefreshInactivityTTL() {
+	now := time.Now()
+	ua.armInactivityTTL(now, now)
 }
 
-// CheckActivity checks the current activity data and sets the inactivity TTL accordingly
+// CheckActivity checks the current activity data and sets the inactivity TTL and ACW policy deadline accordingly. Any
+// activity resets the escalation ladder, but staying in the presence set by a ladder step does not count as activity.
 func (ua *UserActivity) CheckActivity() {
+	ua.armACWDeadline()
+	ua.armSessionDeadline()
+	if ua.InEnforcedState() {
+		return
+	}
+
+	// Not responding or no station counts as inactivity even in an exempt presence
+	if condition, since, minutes, ok := ua.InactivityCondition(); ok {
+		ua.armConditionTTL(condition, since, minutes)
+		return
+	}
+
 	// Clear TTL or update it
-	if ua.GroupID == "" || ua.Conversing || groupconfig.IsPresenceTTLExempt(ua.Presence) {
+	if ua.ExemptReason() != "" {
 		ua.ClearInactivityTTL()
 	} else {
-		ua.SetInactivityTTL(time.Duration(groupconfig.TimeoutGroups[ua.GroupID].TimeoutMinutes) * time.Minute)
+		now := time.Now()
+		ua.armInactivityTTL(now, now)
+	}
+}
+
+// InactivityCondition returns the inactivity condition of the timeout group the user is in (not responding, or no
+// station associated), when it started and its timeout. If both apply, the one that is due first is returned. ok is
+// false if the user is in neither, or is offline or conversing.
+func (ua UserActivity) InactivityCondition() (reason string, since time.Time, minutes int64, ok bool) {
+	group, found := groupconfig.GetTimeoutGroup(ua.GroupID)
+	if !found || ua.Conversing || strings.EqualFold(ua.Presence, "OFFLINE") {
+		return "", time.Time{}, 0, false
+	}
+
+	if group.NotRespondingMinutes > 0 && ua.NotRespondingSince != nil {
+		reason, since, minutes, ok = "not responding", time.UnixMilli(*ua.NotRespondingSince), group.NotRespondingMinutes, true
+	}
+	if group.NoStationMinutes > 0 && ua.NoStationSince != nil {
+		noStationSince := time.UnixMilli(*ua.NoStationSince)
+		due := noStationSince.Add(time.Duration(group.NoStationMinutes) * time.Minute)
+		if !ok || due.Before(since.Add(time.Duration(minutes)*time.Minute)) {
+			reason, since, minutes, ok = "no station associated", noStationSince, group.NoStationMinutes, true
+		}
+	}
+	return reason, since, minutes, ok
+}
+
+// armConditionTTL sets the inactivity TTL for an inactivity condition that started at since. A TTL already armed for
+// the same condition start is kept, so the warning and escalation ladder carry on.
+func (ua *UserActivity) armConditionTTL(condition string, since time.Time, minutes int64) {
+	if ua.InactivityTTL != nil && ua.InactiveSince != nil && *ua.InactiveSince == since.UnixMilli() && ua.Condition == condition {
+		return
+	}
+
+	now := time.Now()
+	ttl := since.Add(time.Duration(minutes) * time.Minute)
+	if ttl.Before(now.Add(minTTLDelay)) {
+		// Keep the TTL in the future so the record is listed as pending
+		ttl = now.Add(minTTLDelay)
+	}
+
+	ua.resetReaperState()
+	ua.InactivityTTL = &[]int64{ttl.UnixMilli()}[0]
+	ua.InactiveSince = &[]int64{since.UnixMilli()}[0]
+	ua.ScheduleBoundary = false
+	ua.Condition = condition
+}
+
+// CheckInactivityConditions re-evaluates the inactivity conditions after a routing status or station change, which
+// doesn't count as activity on its own (e.g. the reaper setting the user off queue). When a condition ends, the
+// activity is checked as usual.
+func (ua *UserActivity) CheckInactivityConditions() {
+	if ua.InEnforcedState() {
+		return
+	}
+	if condition, since, minutes, ok := ua.InactivityCondition(); ok {
+		ua.armConditionTTL(condition, since, minutes)
+		return
+	}
+	if ua.Condition != "" {
+		ua.CheckActivity()
+	}
+}
+
+// UpdateRoutingStatus records the routing status, and when the user started not responding
+func (ua *UserActivity) UpdateRoutingStatus(routingStatus apitypes.RoutingStatus) {
+	if routingStatus.Status == "" {
+		return
+	}
+	ua.RoutingStatus = routingStatus.Status
+
+	if !strings.EqualFold(routingStatus.Status, genesys.RoutingStatusNotResponding) {
+		ua.NotRespondingSince = nil
+		return
+	}
+	if ua.NotRespondingSince == nil {
+		since := routingStatus.StartTime
+		if since.IsZero() {
+			since = time.Now()
+		}
+		ua.NotRespondingSince = &[]int64{since.UnixMilli()}[0]
+	}
+}
+
+// UpdateStation records the station associated with the user, and since when they have been without one
+func (ua *UserActivity) UpdateStation(stations apitypes.StationEventBody, at time.Time) {
+	if stations.AssociatedStation != nil && stations.AssociatedStation.ID != "" {
+		ua.StationID = stations.AssociatedStation.ID
+		ua.NoStationSince = nil
+		return
+	}
+	ua.StationID = ""
+	if ua.NoStationSince == nil {
+		ua.NoStationSince = &[]int64{at.UnixMilli()}[0]
+	}
+}
+
+// armACWDeadline sets the deadline of the timeout group's ACW policy while the user is conversing only through
+// after-call work and the policy has not been enforced in this ACW period yet
+func (ua *UserActivity) armACWDeadline() {
+	group, ok := groupconfig.GetTimeoutGroup(ua.GroupID)
+	if !ok || group.ACWPolicy == nil || ua.ACWSince == nil || ua.ACWEnforcedAt != nil {
+		ua.ACWDeadline = nil
+		return
+	}
+	ua.ACWDeadline = &[]int64{*ua.ACWSince + (time.Duration(group.ACWPolicy.MaxMinutes) * time.Minute).Milliseconds()}[0]
+}
+
+// IsStuckInACW checks if the user has been conversing only through after-call work for longer than their timeout
+// group's ACW policy allows
+func (ua UserActivity) IsStuckInACW(now time.Time) bool {
+	group, ok := groupconfig.GetTimeoutGroup(ua.GroupID)
+	if !ok || group.ACWPolicy == nil || ua.ACWSince == nil {
+		return false
+	}
+	return now.Sub(time.UnixMilli(*ua.ACWSince)) >= time.Duration(group.ACWPolicy.MaxMinutes)*time.Minute
+}
+
+// CompleteACWPolicy records that the ACW policy action was taken, so it is not taken again until the user leaves ACW
+func (ua *UserActivity) CompleteACWPolicy() {
+	ua.ACWEnforcedAt = &[]int64{time.Now().UnixMilli()}[0]
+	ua.ACWDeadline = nil
+	ua.LogoutAttempts = 0
+	ua.LastLogoutError = ""
+	ua.NextLogoutRetry = nil
+	ua.ReleaseClaim()
+}
+
+// UpdateSession starts the session when the user comes online after being offline (or their previous presence is
+// unknown, e.g. the record is created while they are online), and ends it when they go offline. It must be called
+// before the new presence is set.
+func (ua *UserActivity) UpdateSession(systemPresence string, at time.Time) {
+	if strings.EqualFold(systemPresence, "OFFLINE") {
+		ua.SessionStartedAt = nil
+		ua.SessionDeadline = nil
+		ua.SessionEnforcedAt = nil
+		return
+	}
+	if ua.SessionStartedAt == nil && (ua.Presence == "" || strings.EqualFold(ua.Presence, "OFFLINE")) {
+		ua.SessionStartedAt = &[]int64{at.UnixMilli()}[0]
+		if ua.NoStationSince != nil {
+			// Time without a station while offline doesn't count
+			ua.NoStationSince = &[]int64{at.UnixMilli()}[0]
+		}
+	}
+}
+
+// armSessionDeadline sets the deadline of the timeout group's max session length. A deadline that was deferred while
+// the user is conversing is kept until they stop conversing.
+func (ua *UserActivity) armSessionDeadline() {
+	group, ok := groupconfig.GetTimeoutGroup(ua.GroupID)
+	if !ok || group.MaxSessionMinutes == 0 || ua.SessionStartedAt == nil || ua.SessionEnforcedAt != nil {
+		ua.SessionDeadline = nil
+		return
+	}
+
+	deadline := *ua.SessionStartedAt + (time.Duration(group.MaxSessionMinutes) * time.Minute).Milliseconds()
+	if ua.Conversing && ua.SessionDeadline != nil && *ua.SessionDeadline > deadline {
+		return
+	}
+	ua.SessionDeadline = &deadline
+}
+
+// DeferSession postpones the session logout of a conversing user until the time
+func (ua *UserActivity) DeferSession(until time.Time) {
+	ua.SessionDeadline = &[]int64{until.UnixMilli()}[0]
+	ua.ReleaseClaim()
+}
+
+// CompleteSession records that the user was logged out for reaching the max session length
+func (ua *UserActivity) CompleteSession() {
+	ua.SessionEnforcedAt = &[]int64{time.Now().UnixMilli()}[0]
+	ua.SessionDeadline = nil
+	ua.LogoutAttempts = 0
+	ua.LastLogoutError = ""
+	ua.NextLogoutRetry = nil
+	ua.ReleaseClaim()
+}
+
+// ExemptReason returns the reason the user is exempt from the inactivity TTL, or an empty string if they are not
+func (ua UserActivity) ExemptReason() string {
+	group, ok := groupconfig.GetTimeoutGroup(ua.GroupID)
+	if !ok {
+		return "not in a timeout group"
+	}
+	if _, _, _, ok := ua.InactivityCondition(); ok {
+		return ""
 	}
+	if ua.Conversing {
+		if len(ua.ConversingChannels) == 0 {
+			return "conversing"
+		}
+		if ua.ACWSince != nil {
+			return fmt.Sprintf("in after-call work on %s", strings.Join(ua.ConversingChannels, ", "))
+		}
+		return fmt.Sprintf("conversing on %s", strings.Join(ua.ConversingChannels, ", "))
+	}
+	if group.IsPresenceTTLExempt(ua.Presence) {
+		return fmt.Sprintf("presence %s is exempt", ua.Presence)
+	}
+	if override, ok := group.PresenceOverrides[ua.SecondaryPresenceID]; ok && override.Exempt {
+		name := override.Name
+		if name == "" {
+			name = ua.SecondaryPresenceID
+		}
+		return fmt.Sprintf("secondary presence %s is exempt", name)
+	}
+	return ""
+}
+
+// IsStalePresenceEvent checks if the presence event has already been applied or is older than the last applied one
+func (ua UserActivity) IsStalePresenceEvent(eventID string, timestamp time.Time) bool {
+	return (eventID != "" && eventID == ua.PresenceEventID) || timestamp.UnixMilli() < ua.PresenceUpdatedAt
+}
+
+// IsStaleConversationsEvent checks if the conversation summary event has already been applied or is older than the
+// last applied one
+func (ua UserActivity) IsStaleConversationsEvent(eventID string, timestamp time.Time) bool {
+	return (eventID != "" && eventID == ua.ConversationsEventID) || timestamp.UnixMilli() < ua.ConversationsUpdatedAt
+}
+
+// SetPresenceEvent records the presence event as the last applied one
+func (ua *UserActivity) SetPresenceEvent(eventID string, timestamp time.Time) {
+	ua.PresenceEventID = eventID
+	ua.PresenceUpdatedAt = timestamp.UnixMilli()
+}
+
+// IsStaleRoutingStatusEvent checks if the routing status event has already been applied or is older than the last
+// applied one
+func (ua UserActivity) IsStaleRoutingStatusEvent(eventID string, timestamp time.Time) bool {
+	return (eventID != "" && eventID == ua.RoutingStatusEventID) || timestamp.UnixMilli() < ua.RoutingStatusUpdatedAt
+}
+
+// IsStaleStationEvent checks if the station event has already been applied or is older than the last applied one
+func (ua UserActivity) IsStaleStationEvent(eventID string, timestamp time.Time) bool {
+	return (eventID != "" && eventID == ua.StationEventID) || timestamp.UnixMilli() < ua.StationUpdatedAt
+}
+
+// SetRoutingStatusEvent records the routing status event as the last applied one
+func (ua *UserActivity) SetRoutingStatusEvent(eventID string, timestamp time.Time) {
+	ua.RoutingStatusEventID = eventID
+	ua.RoutingStatusUpdatedAt = timestamp.UnixMilli()
 }
 
-// UpdateConversations updates the conversing flag based on the conversation summary
+// SetStationEvent records the station event as the last applied one
+func (ua *UserActivity) SetStationEvent(eventID string, timestamp time.Time) {
+	ua.StationEventID = eventID
+	ua.StationUpdatedAt = timestamp.UnixMilli()
+}
+
+// SetConversationsEvent records the conversation summary event as the last applied one
+func (ua *UserActivity) SetConversationsEvent(eventID string, timestamp time.Time) {
+	ua.ConversationsEventID = eventID
+	ua.ConversationsUpdatedAt = timestamp.UnixMilli()
+}
+
+// UpdateConversations stores the per-channel conversation counters of the conversation summary and updates the
+// conversing flag with the timeout group's conversing rules. It also tracks when the user started conversing only
+// through after-call work.
 func (ua *UserActivity) UpdateConversations(conversationSummary apitypes.ConversationSummaryEventBody) {
-	ua.Conversing = conversationSummary.Call.ContactCenter.Active > 0 ||
-		conversationSummary.Call.ContactCenter.ACW > 0 ||
-		conversationSummary.Call.Enterprise.Active > 0 ||
-		conversationSummary.Callback.ContactCenter.Active > 0 ||
-		conversationSummary.Callback.ContactCenter.ACW > 0 ||
-		conversationSummary.Callback.Enterprise.Active > 0 ||
-		conversationSummary.Chat.ContactCenter.Active > 0 ||
-		conversationSummary.Chat.ContactCenter.ACW > 0 ||
-		conversationSummary.Chat.Enterprise.Active > 0 ||
-		conversationSummary.Email.ContactCenter.Active > 0 ||
-		conversationSummary.Email.ContactCenter.ACW > 0 ||
-		conversationSummary.Email.Enterprise.Active > 0 ||
-		conversationSummary.Message.ContactCenter.Active > 0 ||
-		conversationSummary.Message.ContactCenter.ACW > 0 ||
-		conversationSummary.Message.Enterprise.Active > 0 ||
-		conversationSummary.SocialExpression.ContactCenter.Active > 0 ||
-		conversationSummary.SocialExpression.ContactCenter.ACW > 0 ||
-		conversationSummary.SocialExpression.Enterprise.Active > 0 ||
-		conversationSummary.Video.ContactCenter.Active > 0 ||
-		conversationSummary.Video.ContactCenter.ACW > 0 ||
-		conversationSummary.Video.Enterprise.Active > 0
+	ua.Conversations = make(map[string]ChannelConversations)
+	for channel, metrics := range conversationSummary.Channels() {
+		conversations := ChannelConversations{
+			ContactCenterActive: metrics.ContactCenter.Active,
+			ContactCenterACW:    metrics.ContactCenter.ACW,
+			EnterpriseActive:    metrics.Enterprise.Active,
+			EnterpriseACW:       metrics.Enterprise.ACW,
+		}
+		if conversations != (ChannelConversations{}) {
+			ua.Conversations[channel] = conversations
+		}
+	}
+
+	// Users outside a timeout group get the default rules
+	group, _ := groupconfig.GetTimeoutGroup(ua.GroupID)
+	ua.ConversingChannels = nil
+	active := false
+	for channel, conversations := range ua.Conversations {
+		conversing := false
+		for _, counter := range group.ConversingCounters(channel) {
+			if conversations.Count(counter) > 0 {
+				conversing = true
+				active = active || !groupconfig.IsACWCounter(counter)
+			}
+		}
+		if conversing {
+			ua.ConversingChannels = append(ua.ConversingChannels, channel)
+		}
+	}
+	sort.Strings(ua.ConversingChannels)
+	ua.Conversing = len(ua.ConversingChannels) > 0
+
+	if !ua.Conversing || active {
+		ua.ACWSince = nil
+		ua.ACWDeadline = nil
+		ua.ACWEnforcedAt = nil
+	} else if ua.ACWSince == nil {
+		ua.ACWSince = &[]int64{time.Now().UnixMilli()}[0]
+	}
 }
 
 // RefreshUser fetches the current Genesys user data and fully updates the UserActivity object
-func (ua *UserActivity) RefreshUser() {
+func (ua *UserActivity) RefreshUser(ctx context.Context, gc genesys.Client) {
 	// Get current user data
-	genesysUser, err := genesys.GetUser(ua.UserID)
+	genesysUser, err := gc.GetUser(ctx, ua.UserID)
 	if err != nil {
+		// Keep the current data
 		fmt.Printf("failed to get Genesys user: %v\n", err)
+		return
 	}
 
+	ua.ApplyGenesysUser(*genesysUser)
+}
+
+// ApplyGenesysUser fully updates the UserActivity object with the Genesys user data and checks the activity
+func (ua *UserActivity) ApplyGenesysUser(genesysUser genesys.GenesysUser) {
 	// Update user activity with current data
-	ua.GroupID = chooseTimeoutGroupID(genesysUser.Groups)
+	groupID := chooseTimeoutGroupID(genesysUser.Groups)
+	if groupID != ua.GroupID {
+		logTimeoutGroupChange(ua.UserID, ua.GroupID, groupID)
+	}
+	ua.GroupID = groupID
+	ua.ApplyLiveState(genesysUser)
+
+	// Check activity
+	ua.CheckActivity()
+}
+
+// ApplyLiveState updates the presence, conversations, routing status and station of the UserActivity object with the
+// Genesys user data, without checking the activity
+func (ua *UserActivity) ApplyLiveState(genesysUser genesys.GenesysUser) {
+	ua.UpdateSession(genesysUser.Presence.PresenceDefinition.SystemPresence, time.Now())
 	ua.Presence = genesysUser.Presence.PresenceDefinition.SystemPresence
 	ua.SecondaryPresenceID = genesysUser.Presence.PresenceDefinition.ID
 	ua.UpdateConversations(genesysUser.ConversationSummary)
+	ua.UpdateRoutingStatus(genesysUser.RoutingStatus)
+	if genesysUser.Station != nil {
+		ua.UpdateStation(*genesysUser.Station, time.Now())
+	}
+}
 
-	// Check activity
-	ua.CheckActivity()
+// ApplyInactivityConditions updates the routing status and station from the Genesys user data (if they were fetched)
+// and re-evaluates the inactivity conditions. Like routing status and station events, this doesn't count as activity.
+func (ua *UserActivity) ApplyInactivityConditions(genesysUser genesys.GenesysUser) {
+	ua.UpdateRoutingStatus(genesysUser.RoutingStatus)
+	if genesysUser.Station != nil {
+		ua.UpdateStation(*genesysUser.Station, time.Now())
+	}
+	ua.CheckInactivityConditions()
+}
+
+// ChangeTimeoutGroup moves the user to the timeout group of their Genesys groups if it changed. The conversations are
+// re-evaluated with the new group's rules, and the inactivity TTL is re-armed with its timeout, keeping the time the
+// user has already been inactive. It returns false if the timeout group didn't change.
+func (ua *UserActivity) ChangeTimeoutGroup(genesysUser genesys.GenesysUser) bool {
+	groupID := timeoutGroupID(genesysUser.Groups)
+	if groupID == ua.GroupID {
+		return false
+	}
+
+	logTimeoutGroupChange(ua.UserID, ua.GroupID, groupID)
+	ua.GroupID = groupID
+	ua.UpdateConversations(genesysUser.ConversationSummary)
+	ua.armACWDeadline()
+	ua.armSessionDeadline()
+	if condition, since, minutes, ok := ua.InactivityCondition(); ok {
+		// Re-arm with the new group's timeout for the condition
+		ua.InactivityTTL = nil
+		ua.armConditionTTL(condition, since, minutes)
+	} else if ua.ExemptReason() != "" {
+		ua.ClearInactivityTTL()
+	} else {
+		ua.ReevaluateSchedule()
+	}
+	return true
+}
+
+// Drift describes how the stored state differs from the Genesys user data, or returns nil if it doesn't
+func (ua UserActivity) Drift(genesysUser genesys.GenesysUser) []string {
+	live := ua
+	live.GroupID = timeoutGroupID(genesysUser.Groups)
+	live.Presence = genesysUser.Presence.PresenceDefinition.SystemPresence
+	live.SecondaryPresenceID = genesysUser.Presence.PresenceDefinition.ID
+	live.UpdateConversations(genesysUser.ConversationSummary)
+	live.ApplyInactivityConditions(genesysUser)
+
+	var drift []string
+	if live.GroupID != ua.GroupID {
+		drift = append(drift, fmt.Sprintf("group %q != %q", ua.GroupID, live.GroupID))
+	}
+	// Events use the ON_QUEUE form of system presences, the API uses On Queue
+	if !strings.EqualFold(strings.ReplaceAll(ua.Presence, " ", "_"), strings.ReplaceAll(live.Presence, " ", "_")) {
+		drift = append(drift, fmt.Sprintf("presence %q != %q", ua.Presence, live.Presence))
+	}
+	if live.SecondaryPresenceID != ua.SecondaryPresenceID {
+		drift = append(drift, fmt.Sprintf("secondary presence %q != %q", ua.SecondaryPresenceID, live.SecondaryPresenceID))
+	}
+	if live.Conversing != ua.Conversing || !slices.Equal(live.ConversingChannels, ua.ConversingChannels) {
+		drift = append(drift, fmt.Sprintf("conversing on %v != %v", ua.ConversingChannels, live.ConversingChannels))
+	}
+	if !strings.EqualFold(live.RoutingStatus, ua.RoutingStatus) {
+		drift = append(drift, fmt.Sprintf("routing status %q != %q", ua.RoutingStatus, live.RoutingStatus))
+	}
+	if live.StationID != ua.StationID {
+		drift = append(drift, fmt.Sprintf("station %q != %q", ua.StationID, live.StationID))
+	}
+	return drift
 }
 
 // chooseTimeoutGroupID chooses the timeout group with the longest timeout from the list of assigned groups
 func chooseTimeoutGroupID(genesysGroups []genesys.GenesysGroup) string {
+	targetGroupID := timeoutGroupID(genesysGroups)
+	if targetGroupID == "" {
+		fmt.Println("No timeout group found for user")
+		return ""
+	}
+
+	targetGroup, _ := groupconfig.GetTimeoutGroup(targetGroupID)
+	fmt.Printf("Using timeout group: %s (%v)\n", targetGroupID, targetGroup.InactivityMinutes())
+
+	return targetGroupID
+}
+
+// timeoutGroupID returns the timeout group with the longest timeout from the list of assigned groups, without logging
+// the choice
+func timeoutGroupID(genesysGroups []genesys.GenesysGroup) string {
 	var targetGroupID string
 	var targetGroup *groupconfig.TimeoutGroup
 
 	// Choose group with longest timeout
+	timeoutGroups := groupconfig.GetTimeoutGroups()
 	for _, genesysGroup := range genesysGroups {
-		if _, ok := groupconfig.TimeoutGroups[genesysGroup.ID]; ok {
-			timeoutGroup := groupconfig.TimeoutGroups[genesysGroup.ID]
-			if targetGroup == nil || timeoutGroup.TimeoutMinutes > targetGroup.TimeoutMinutes {
+		if timeoutGroup, ok := timeoutGroups[genesysGroup.ID]; ok {
+			if targetGroup == nil || timeoutGroup.InactivityMinutes() > targetGroup.InactivityMinutes() {
 				targetGroupID = genesysGroup.ID
 				targetGroup = &timeoutGroup
 			}
 		}
 	}
 
-	if targetGroupID == "" {
-		fmt.Println("No timeout group found for user")
-		return ""
+	return targetGroupID
+}
+
+// logTimeoutGroupChange logs that the user was moved to another timeout group
+func logTimeoutGroupChange(userID string, fromGroupID string, toGroupID string) {
+	fmt.Printf("timeout group of user %s changed from %s to %s\n", userID, timeoutGroupLabel(fromGroupID), timeoutGroupLabel(toGroupID))
+}
+
+// timeoutGroupLabel names the timeout group for logging
+func timeoutGroupLabel(groupID string) string {
+	if groupID == "" {
+		return "none"
 	}
+	if group, ok := groupconfig.GetTimeoutGroup(groupID); ok {
+		return fmt.Sprintf("%s (%s)", group.Name, groupID)
+	}
+	return groupID
+}
 
-	fmt.Printf("Using timeout group: %s (%v)\n", targetGroupID, targetGroup.TimeoutMinutes)
+// ReaperEvent records a decision the reaper made about a user
+type ReaperEvent struct {
+	// EventID tells apart the events of a user written in the same millisecond
+	EventID       string `json:"eventId" dynamodbav:"eventId"`
+	UserID        string `json:"userId" dynamodbav:"userId"`
+	Action        string `json:"action" dynamodbav:"action"`
+	Reason        string `json:"reason" dynamodbav:"reason"`
+	GroupID       string `json:"groupId" dynamodbav:"groupId"`
+	Presence      string `json:"presence" dynamodbav:"presence"`
+	InactivityTTL *int64 `json:"inactivityTTL" dynamodbav:"inactivityTTL"`
+	Timestamp     int64  `json:"timestamp" dynamodbav:"timestamp"`
+	// Enforcement is the enforcement action taken, or that would have been taken in dry-run mode
+	Enforcement string `json:"enforcement,omitempty" dynamodbav:"enforcement,omitempty"`
+}
 
-	return targetGroupID
+// ReaperEventEntity is an aggregate type for the DB record for a ReaperEvent object
+type ReaperEventEntity struct {
+	singleTableEntity
+	singleTableEntityListGSI
+	ReaperEvent
+}
+
+// NewReaperEvent creates a reaper event from the current state of the UserActivity object
+func NewReaperEvent(ua UserActivity, action string, reason string) ReaperEvent {
+	return ReaperEvent{
+		EventID:       fmt.Sprintf("%016x", rand.Uint64()),
+		UserID:        ua.UserID,
+		Action:        action,
+		Reason:        reason,
+		GroupID:       ua.GroupID,
+		Presence:      ua.Presence,
+		InactivityTTL: ua.InactivityTTL,
+		Timestamp:     time.Now().UnixMilli(),
+	}
+}
+
+func ReaperEventListGSIPK(action string) string {
+	return strings.ToLower(fmt.Sprintf("%s|%s", reaperEventPrefix, action))
+}
+
+// Entity creates a DB entity from the ReaperEvent object
+func (re ReaperEvent) Entity() ReaperEventEntity {
+	return ReaperEventEntity{
+		singleTableEntity: singleTableEntity{
+			PartitionKey: fmt.Sprintf("%s|%s", reaperEventPrefix, re.UserID),
+			SortKey:      fmt.Sprintf("%s|%d|%s|%s", reaperEventPrefix, re.Timestamp, re.Action, re.EventID),
+			TTL:          &[]int64{time.Now().AddDate(0, 1, 0).Unix()}[0],
+		},
+		singleTableEntityListGSI: singleTableEntityListGSI{
+			ListItemGSIPK: ReaperEventListGSIPK(re.Action),
+			ListItemGSISK: fmt.Sprintf("%d", re.Timestamp),
+		},
+		ReaperEvent: re,
+	}
+}
+
+// Lease is a lock item that lets one owner at a time run a job. The owner extends the expiry with heartbeats while it
+// runs; a lease that was not released is taken over once it expires.
+type Lease struct {
+	Name        string `json:"name" dynamodbav:"name"`
+	Owner       string `json:"owner" dynamodbav:"owner"`
+	ExpiresAt   int64  `json:"expiresAt" dynamodbav:"expiresAt"`
+	HeartbeatAt int64  `json:"heartbeatAt" dynamodbav:"heartbeatAt"`
+}
+
+// LeaseEntity is an aggregate type for the DB record for a Lease object
+type LeaseEntity struct {
+	singleTableEntity
+	Lease
+}
+
+// LeaseHeldError is returned when a lease is held by another owner
+type LeaseHeldError struct {
+	Name      string
+	Owner     string
+	ExpiresAt int64
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf("lease %s is held by %s until %d", e.Name, e.Owner, e.ExpiresAt)
+}
+
+func LeasePK(name string) string {
+	return fmt.Sprintf("%s|%s", leasePrefix, name)
+}
+
+// Entity creates a DB entity from the Lease object
+func (l Lease) Entity() LeaseEntity {
+	return LeaseEntity{
+		singleTableEntity: singleTableEntity{
+			PartitionKey: LeasePK(l.Name),
+			SortKey:      LeasePK(l.Name),
+			TTL:          &[]int64{time.UnixMilli(l.ExpiresAt).AddDate(0, 0, 1).Unix()}[0],
+		},
+		Lease: l,
+	}
+}
+
+// Cursor is how far a job that works through a few user activity records per run got, e.g. reconciliation looking for
+// users who left their timeout group
+type Cursor struct {
+	Name string `json:"name" dynamodbav:"name"`
+	// Status is the user activity list the job is paging through, and Position the store's cursor in the list (empty
+	// at its start)
+	Status    string `json:"status" dynamodbav:"status"`
+	Position  string `json:"position" dynamodbav:"position"`
+	UpdatedAt int64  `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// CursorEntity is an aggregate type for the DB record for a Cursor object
+type CursorEntity struct {
+	singleTableEntity
+	Cursor
+}
+
+func CursorPK(name string) string {
+	return fmt.Sprintf("%s|%s", cursorPrefix, name)
+}
+
+// Entity creates a DB entity from the Cursor object
+func (c Cursor) Entity() CursorEntity {
+	return CursorEntity{
+		singleTableEntity: singleTableEntity{
+			PartitionKey: CursorPK(c.Name),
+			SortKey:      CursorPK(c.Name),
+			TTL:          &[]int64{time.UnixMilli(c.UpdatedAt).AddDate(0, 1, 0).Unix()}[0],
+		},
+		Cursor: c,
+	}
 }
@@ -0,0 +1,559 @@
+package db
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+	"user-activity-monitor/src/apitypes"
+	"user-activity-monitor/src/groupconfig"
+)
+
+func TestUpdateSession(t *testing.T) {
+	at := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	earlier := at.Add(-time.Hour).UnixMilli()
+
+	tests := []struct {
+		name             string
+		ua               UserActivity
+		systemPresence   string
+		wantSessionStart *int64
+	}{
+		{
+			name:             "first event while online",
+			ua:               UserActivity{UserID: "user"},
+			systemPresence:   "AVAILABLE",
+			wantSessionStart: &[]int64{at.UnixMilli()}[0],
+		},
+		{
+			name:           "first event while offline",
+			ua:             UserActivity{UserID: "user"},
+			systemPresence: "OFFLINE",
+		},
+		{
+			name:             "online after offline",
+			ua:               UserActivity{UserID: "user", Presence: "OFFLINE"},
+			systemPresence:   "AVAILABLE",
+			wantSessionStart: &[]int64{at.UnixMilli()}[0],
+		},
+		{
+			name:           "already online without a session",
+			ua:             UserActivity{UserID: "user", Presence: "AVAILABLE"},
+			systemPresence: "BUSY",
+		},
+		{
+			name:             "presence change during a session",
+			ua:               UserActivity{UserID: "user", Presence: "AVAILABLE", SessionStartedAt: &earlier},
+			systemPresence:   "BUSY",
+			wantSessionStart: &earlier,
+		},
+		{
+			name:           "offline ends the session",
+			ua:             UserActivity{UserID: "user", Presence: "AVAILABLE", SessionStartedAt: &earlier},
+			systemPresence: "OFFLINE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ua := tt.ua
+			ua.UpdateSession(tt.systemPresence, at)
+
+			switch {
+			case tt.wantSessionStart == nil && ua.SessionStartedAt != nil:
+				t.Errorf("SessionStartedAt = %d, want nil", *ua.SessionStartedAt)
+			case tt.wantSessionStart != nil && ua.SessionStartedAt == nil:
+				t.Errorf("SessionStartedAt = nil, want %d", *tt.wantSessionStart)
+			case tt.wantSessionStart != nil && *ua.SessionStartedAt != *tt.wantSessionStart:
+				t.Errorf("SessionStartedAt = %d, want %d", *ua.SessionStartedAt, *tt.wantSessionStart)
+			}
+		})
+	}
+}
+
+func TestReaperEventsInTheSameMillisecond(t *testing.T) {
+	SetStore(NewMemoryStore())
+
+	ua := UserActivity{UserID: "7d3e2c1b-4a5f-4e6d-8c7b-9a0f1e2d3c4b"}
+	skipped := NewReaperEvent(ua, ReaperEventSkipped, "user is active")
+	enforced := NewReaperEvent(ua, ReaperEventEnforced, "inactive")
+	retried := NewReaperEvent(ua, ReaperEventEnforced, "inactive")
+	enforced.Timestamp = skipped.Timestamp
+	retried.Timestamp = skipped.Timestamp
+
+	for _, re := range []ReaperEvent{skipped, enforced, retried} {
+		if err := WriteReaperEvent(re); err != nil {
+			t.Fatalf("failed to write reaper event: %v", err)
+		}
+	}
+
+	since := skipped.Timestamp - 1
+	if events, err := ListReaperEvents(ReaperEventSkipped, since); err != nil || len(events) != 1 {
+		t.Errorf("skipped events = %+v (%v), want 1", events, err)
+	}
+	if events, err := ListReaperEvents(ReaperEventEnforced, since); err != nil || len(events) != 2 {
+		t.Errorf("enforced events = %+v (%v), want 2", events, err)
+	}
+}
+
+func TestCompleteStep(t *testing.T) {
+	groupID := "0f6c1b4e-3d2a-4c8e-9b7f-5a1d2e3f4a5b"
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		groupID: {
+			Name: "Timeout Group - test",
+			Steps: []groupconfig.Step{
+				{AfterMinutes: 15, Action: groupconfig.ActionPresenceAway},
+				{AfterMinutes: 30, Action: groupconfig.ActionOffQueue},
+				{AfterMinutes: 60, Action: groupconfig.ActionLogout},
+			},
+		},
+	})
+
+	now := time.Now()
+	minutesAgo := func(minutes int) *int64 {
+		return &[]int64{now.Add(-time.Duration(minutes) * time.Minute).UnixMilli()}[0]
+	}
+
+	tests := []struct {
+		name          string
+		inactiveSince *int64
+		// ttl is the deadline of the first step
+		ttl        *int64
+		wantNextAt time.Time
+	}{
+		{"group timeout", minutesAgo(15), minutesAgo(0), now.Add(15 * time.Minute)},
+		// A 5 minute condition timeout or a 20 minute presence override set the first deadline
+		{"shorter first deadline", minutesAgo(5), minutesAgo(0), now.Add(25 * time.Minute)},
+		{"longer first deadline", minutesAgo(20), minutesAgo(0), now.Add(10 * time.Minute)},
+		{"first deadline past the next step", minutesAgo(45), minutesAgo(0), now},
+		{"no inactive since", nil, minutesAgo(0), now.Add(15 * time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ua := UserActivity{GroupID: groupID, InactiveSince: tt.inactiveSince, InactivityTTL: tt.ttl}
+			ua.CompleteStep("AWAY")
+
+			if ua.LadderStep != 1 || ua.NextStepAt == nil {
+				t.Fatalf("ladder step = %d, next step at %v, want step 1 with a deadline", ua.LadderStep, ua.NextStepAt)
+			}
+			if diff := time.UnixMilli(*ua.NextStepAt).Sub(tt.wantNextAt); diff < -time.Second || diff > 10*time.Second {
+				t.Errorf("next step at %v, want %v", time.UnixMilli(*ua.NextStepAt), tt.wantNextAt)
+			}
+		})
+	}
+}
+
+func TestListUserActivityPage(t *testing.T) {
+	SetStore(NewMemoryStore())
+
+	for i := 0; i < 5; i++ {
+		ua := UserActivity{UserID: fmt.Sprintf("user-%d", i), Presence: "OFFLINE"}
+		if err := SaveUserActivity(ua); err != nil {
+			t.Fatalf("failed to store user activity: %v", err)
+		}
+	}
+
+	var userIDs []string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		page, next, err := ListUserActivityPage(StatusExempt, cursor, 2)
+		if err != nil {
+			t.Fatalf("failed to list user activity: %v", err)
+		}
+		for _, ua := range page {
+			userIDs = append(userIDs, ua.UserID)
+		}
+		if next == "" {
+			break
+		}
+		if pages > 5 {
+			t.Fatal("paging did not end")
+		}
+		cursor = next
+	}
+
+	if len(userIDs) != 5 {
+		t.Errorf("listed %v, want every user once", userIDs)
+	}
+}
+
+func TestUpdateConversations(t *testing.T) {
+	groupID := "2b8e4f6a-1c3d-4e5f-8a9b-0c1d2e3f4a5b"
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		groupID: {
+			Name:           "Timeout Group - test",
+			TimeoutMinutes: 15,
+			ConversingRules: map[string][]string{
+				groupconfig.ChannelCall:  {groupconfig.CounterContactCenterActive},
+				groupconfig.ChannelEmail: {groupconfig.CounterContactCenterActive, groupconfig.CounterContactCenterACW},
+			},
+		},
+	})
+
+	active := apitypes.ChannelActivity{Active: 1}
+	acw := apitypes.ChannelActivity{ACW: 1}
+
+	tests := []struct {
+		name         string
+		groupID      string
+		summary      apitypes.ConversationSummaryEventBody
+		wantChannels []string
+		wantCounted  []string
+		wantACW      bool
+	}{
+		{
+			name:    "no conversations",
+			groupID: groupID,
+		},
+		{
+			name:         "active call",
+			groupID:      groupID,
+			summary:      apitypes.ConversationSummaryEventBody{Call: apitypes.ChannelMetrics{ContactCenter: active}},
+			wantChannels: []string{"call"},
+			wantCounted:  []string{"call"},
+		},
+		{
+			name:        "counter not in the channel's rules",
+			groupID:     groupID,
+			summary:     apitypes.ConversationSummaryEventBody{Call: apitypes.ChannelMetrics{Enterprise: active}},
+			wantCounted: []string{"call"},
+		},
+		{
+			name:        "channel not in the rules",
+			groupID:     groupID,
+			summary:     apitypes.ConversationSummaryEventBody{Chat: apitypes.ChannelMetrics{ContactCenter: active}},
+			wantCounted: []string{"chat"},
+		},
+		{
+			name:         "after-call work only",
+			groupID:      groupID,
+			summary:      apitypes.ConversationSummaryEventBody{Email: apitypes.ChannelMetrics{ContactCenter: acw}},
+			wantChannels: []string{"email"},
+			wantCounted:  []string{"email"},
+			wantACW:      true,
+		},
+		{
+			name:    "active and after-call work on several channels",
+			groupID: groupID,
+			summary: apitypes.ConversationSummaryEventBody{
+				Email: apitypes.ChannelMetrics{ContactCenter: acw},
+				Call:  apitypes.ChannelMetrics{ContactCenter: active},
+				Chat:  apitypes.ChannelMetrics{ContactCenter: active},
+			},
+			wantChannels: []string{"call", "email"},
+			wantCounted:  []string{"call", "chat", "email"},
+		},
+		{
+			name:         "default rules count contact center after-call work",
+			summary:      apitypes.ConversationSummaryEventBody{Chat: apitypes.ChannelMetrics{ContactCenter: acw}},
+			wantChannels: []string{"chat"},
+			wantCounted:  []string{"chat"},
+			wantACW:      true,
+		},
+		{
+			name:        "default rules don't count enterprise after-call work",
+			summary:     apitypes.ConversationSummaryEventBody{Chat: apitypes.ChannelMetrics{Enterprise: acw}},
+			wantCounted: []string{"chat"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ua := UserActivity{UserID: "user", GroupID: tt.groupID}
+			ua.UpdateConversations(tt.summary)
+
+			if !slices.Equal(ua.ConversingChannels, tt.wantChannels) {
+				t.Errorf("ConversingChannels = %v, want %v", ua.ConversingChannels, tt.wantChannels)
+			}
+			if ua.Conversing != (len(tt.wantChannels) > 0) {
+				t.Errorf("Conversing = %v, want %v", ua.Conversing, len(tt.wantChannels) > 0)
+			}
+			counted := slices.Sorted(maps.Keys(ua.Conversations))
+			if !slices.Equal(counted, tt.wantCounted) {
+				t.Errorf("channels with counters = %v, want %v", counted, tt.wantCounted)
+			}
+			if (ua.ACWSince != nil) != tt.wantACW {
+				t.Errorf("ACWSince = %v, want set %v", ua.ACWSince, tt.wantACW)
+			}
+		})
+	}
+}
+
+func TestUpdateConversationsKeepsCounters(t *testing.T) {
+	ua := UserActivity{UserID: "user"}
+	ua.UpdateConversations(apitypes.ConversationSummaryEventBody{
+		Call: apitypes.ChannelMetrics{
+			ContactCenter: apitypes.ChannelActivity{Active: 2, ACW: 1},
+			Enterprise:    apitypes.ChannelActivity{Active: 3, ACW: 4},
+		},
+	})
+
+	want := ChannelConversations{ContactCenterActive: 2, ContactCenterACW: 1, EnterpriseActive: 3, EnterpriseACW: 4}
+	if got := ua.Conversations["call"]; got != want {
+		t.Errorf("call counters = %+v, want %+v", got, want)
+	}
+	for _, counter := range groupconfig.ConversationCounters {
+		if ua.Conversations["call"].Count(counter) == 0 {
+			t.Errorf("Count(%s) = 0, want the call's counter", counter)
+		}
+	}
+
+	// A later summary replaces the counters, dropping channels that are back to zero
+	ua.UpdateConversations(apitypes.ConversationSummaryEventBody{})
+	if len(ua.Conversations) != 0 || ua.Conversing {
+		t.Errorf("Conversations = %+v, conversing %v, want none", ua.Conversations, ua.Conversing)
+	}
+}
+
+func TestACWDeadline(t *testing.T) {
+	groupID := "5c9d0e1f-2a3b-4c5d-8e6f-7a8b9c0d1e2f"
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		groupID: {
+			Name:           "Timeout Group - test",
+			TimeoutMinutes: 15,
+			ACWPolicy:      &groupconfig.ACWPolicy{MaxMinutes: 10},
+		},
+	})
+
+	acw := apitypes.ConversationSummaryEventBody{Call: apitypes.ChannelMetrics{ContactCenter: apitypes.ChannelActivity{ACW: 1}}}
+	active := apitypes.ConversationSummaryEventBody{Call: apitypes.ChannelMetrics{ContactCenter: apitypes.ChannelActivity{Active: 1}}}
+
+	// Going into after-call work arms the deadline MaxMinutes after it started
+	ua := UserActivity{UserID: "user", GroupID: groupID, Presence: "AVAILABLE"}
+	ua.UpdateConversations(acw)
+	ua.CheckActivity()
+	if ua.ACWSince == nil || ua.ACWDeadline == nil {
+		t.Fatalf("ACWSince = %v, ACWDeadline = %v, want both set", ua.ACWSince, ua.ACWDeadline)
+	}
+	acwSince := *ua.ACWSince
+	if want := acwSince + (10 * time.Minute).Milliseconds(); *ua.ACWDeadline != want {
+		t.Errorf("ACWDeadline = %d, want %d", *ua.ACWDeadline, want)
+	}
+	if ua.Status() != StatusPending || ua.DueAt() == nil || *ua.DueAt() != *ua.ACWDeadline {
+		t.Errorf("status %s due at %v, want pending until the ACW deadline", ua.Status(), ua.DueAt())
+	}
+
+	// Later summaries during the same after-call work keep when it started
+	ua.UpdateConversations(acw)
+	ua.CheckActivity()
+	if ua.ACWSince == nil || *ua.ACWSince != acwSince {
+		t.Errorf("ACWSince = %v after another ACW summary, want %d", ua.ACWSince, acwSince)
+	}
+
+	// Once enforced, the policy isn't armed again until the user leaves after-call work
+	ua.CompleteACWPolicy()
+	ua.CheckActivity()
+	if ua.ACWDeadline != nil || ua.ACWEnforcedAt == nil {
+		t.Errorf("ACWDeadline = %v, ACWEnforcedAt = %v after enforcement, want no deadline", ua.ACWDeadline, ua.ACWEnforcedAt)
+	}
+
+	// An active interaction ends the after-call work period
+	ua.UpdateConversations(active)
+	ua.CheckActivity()
+	if ua.ACWSince != nil || ua.ACWDeadline != nil || ua.ACWEnforcedAt != nil {
+		t.Errorf("ACWSince = %v, ACWDeadline = %v, ACWEnforcedAt = %v while active, want none", ua.ACWSince, ua.ACWDeadline, ua.ACWEnforcedAt)
+	}
+
+	// The next after-call work period is enforced again
+	ua.UpdateConversations(acw)
+	ua.CheckActivity()
+	if ua.ACWDeadline == nil {
+		t.Error("ACWDeadline = nil in the next after-call work period, want it armed")
+	}
+}
+
+func TestIsStuckInACW(t *testing.T) {
+	groupID := "5c9d0e1f-2a3b-4c5d-8e6f-7a8b9c0d1e2f"
+	noPolicyGroupID := "6d0e1f2a-3b4c-4d5e-9f6a-7b8c9d0e1f2a"
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		groupID:         {Name: "Timeout Group - test", TimeoutMinutes: 15, ACWPolicy: &groupconfig.ACWPolicy{MaxMinutes: 10}},
+		noPolicyGroupID: {Name: "Timeout Group - no ACW policy", TimeoutMinutes: 15},
+	})
+
+	now := time.Now()
+	minutesAgo := func(minutes int) *int64 {
+		return &[]int64{now.Add(-time.Duration(minutes) * time.Minute).UnixMilli()}[0]
+	}
+
+	tests := []struct {
+		name     string
+		groupID  string
+		acwSince *int64
+		want     bool
+	}{
+		{"not in after-call work", groupID, nil, false},
+		{"within the policy", groupID, minutesAgo(5), false},
+		{"at the limit", groupID, minutesAgo(10), true},
+		{"past the limit", groupID, minutesAgo(30), true},
+		{"group without an ACW policy", noPolicyGroupID, minutesAgo(30), false},
+		{"not in a timeout group", "", minutesAgo(30), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ua := UserActivity{UserID: "user", GroupID: tt.groupID, ACWSince: tt.acwSince}
+			if got := ua.IsStuckInACW(now); got != tt.want {
+				t.Errorf("IsStuckInACW = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInactivityConditionTTL(t *testing.T) {
+	groupID := "8f2a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b5c"
+	noConditionsGroupID := "9a3b4c5d-6e7f-4a8b-9c0d-1e2f3a4b5c6d"
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		groupID:             {Name: "Timeout Group - test", TimeoutMinutes: 30, NotRespondingMinutes: 5, NoStationMinutes: 10},
+		noConditionsGroupID: {Name: "Timeout Group - no conditions", TimeoutMinutes: 30},
+	})
+
+	now := time.Now()
+	minutesAgo := func(minutes int) *int64 {
+		return &[]int64{now.Add(-time.Duration(minutes) * time.Minute).UnixMilli()}[0]
+	}
+
+	tests := []struct {
+		name               string
+		ua                 UserActivity
+		wantCondition      string
+		wantInactiveSince  *int64
+		wantTTL            *time.Time
+		wantRegularTimeout bool
+	}{
+		{
+			name:              "not responding in an exempt presence",
+			ua:                UserActivity{GroupID: groupID, Presence: "ON_QUEUE", NotRespondingSince: minutesAgo(2)},
+			wantCondition:     "not responding",
+			wantInactiveSince: minutesAgo(2),
+			wantTTL:           &[]time.Time{now.Add(3 * time.Minute)}[0],
+		},
+		{
+			name:              "not responding past the timeout",
+			ua:                UserActivity{GroupID: groupID, Presence: "ON_QUEUE", NotRespondingSince: minutesAgo(20)},
+			wantCondition:     "not responding",
+			wantInactiveSince: minutesAgo(20),
+			wantTTL:           &[]time.Time{now.Add(minTTLDelay)}[0],
+		},
+		{
+			name:              "no station",
+			ua:                UserActivity{GroupID: groupID, Presence: "AVAILABLE", NoStationSince: minutesAgo(1)},
+			wantCondition:     "no station associated",
+			wantInactiveSince: minutesAgo(1),
+			wantTTL:           &[]time.Time{now.Add(9 * time.Minute)}[0],
+		},
+		{
+			name:              "no station due before not responding",
+			ua:                UserActivity{GroupID: groupID, Presence: "ON_QUEUE", NotRespondingSince: minutesAgo(1), NoStationSince: minutesAgo(8)},
+			wantCondition:     "no station associated",
+			wantInactiveSince: minutesAgo(8),
+			wantTTL:           &[]time.Time{now.Add(2 * time.Minute)}[0],
+		},
+		{
+			name:              "not responding due before no station",
+			ua:                UserActivity{GroupID: groupID, Presence: "ON_QUEUE", NotRespondingSince: minutesAgo(4), NoStationSince: minutesAgo(2)},
+			wantCondition:     "not responding",
+			wantInactiveSince: minutesAgo(4),
+			wantTTL:           &[]time.Time{now.Add(time.Minute)}[0],
+		},
+		{
+			name: "conversing",
+			ua:   UserActivity{GroupID: groupID, Presence: "ON_QUEUE", NotRespondingSince: minutesAgo(2), Conversing: true},
+		},
+		{
+			name: "offline",
+			ua:   UserActivity{GroupID: groupID, Presence: "OFFLINE", NoStationSince: minutesAgo(2)},
+		},
+		{
+			name: "conditions disabled in an exempt presence",
+			ua:   UserActivity{GroupID: noConditionsGroupID, Presence: "ON_QUEUE", NotRespondingSince: minutesAgo(2), NoStationSince: minutesAgo(2)},
+		},
+		{
+			name:               "conditions disabled",
+			ua:                 UserActivity{GroupID: noConditionsGroupID, Presence: "AVAILABLE", NoStationSince: minutesAgo(2)},
+			wantTTL:            &[]time.Time{now.Add(30 * time.Minute)}[0],
+			wantRegularTimeout: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ua := tt.ua
+			ua.UserID = "user"
+			ua.CheckActivity()
+
+			if ua.Condition != tt.wantCondition {
+				t.Errorf("Condition = %q, want %q", ua.Condition, tt.wantCondition)
+			}
+			if tt.wantTTL == nil {
+				if ua.InactivityTTL != nil {
+					t.Errorf("InactivityTTL = %v, want none", time.UnixMilli(*ua.InactivityTTL))
+				}
+				return
+			}
+			if ua.InactivityTTL == nil {
+				t.Fatalf("InactivityTTL = nil, want %v", *tt.wantTTL)
+			}
+			if diff := time.UnixMilli(*ua.InactivityTTL).Sub(*tt.wantTTL); diff < -time.Second || diff > time.Second {
+				t.Errorf("InactivityTTL = %v, want %v", time.UnixMilli(*ua.InactivityTTL), *tt.wantTTL)
+			}
+			if tt.wantRegularTimeout {
+				return
+			}
+			if ua.InactiveSince == nil || *ua.InactiveSince != *tt.wantInactiveSince {
+				t.Errorf("InactiveSince = %v, want %d", ua.InactiveSince, *tt.wantInactiveSince)
+			}
+		})
+	}
+}
+
+func TestInactivityConditionLifecycle(t *testing.T) {
+	groupID := "8f2a3b4c-5d6e-4f7a-8b9c-0d1e2f3a4b5c"
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		groupID: {Name: "Timeout Group - test", TimeoutMinutes: 30, NotRespondingMinutes: 5, NoStationMinutes: 10},
+	})
+
+	startTime := time.Now().Add(-2 * time.Minute).Truncate(time.Millisecond)
+	ua := UserActivity{UserID: "user", GroupID: groupID, Presence: "ON_QUEUE", StationID: "station"}
+
+	// The condition starts when the routing status changed, not when the event was received
+	ua.UpdateRoutingStatus(apitypes.RoutingStatus{Status: "NOT_RESPONDING", StartTime: startTime})
+	ua.CheckInactivityConditions()
+	if ua.Condition != "not responding" || ua.InactivityTTL == nil {
+		t.Fatalf("Condition = %q, InactivityTTL = %v, want the not responding TTL", ua.Condition, ua.InactivityTTL)
+	}
+	if want := startTime.Add(5 * time.Minute).UnixMilli(); *ua.InactivityTTL != want {
+		t.Errorf("InactivityTTL = %v, want %v", time.UnixMilli(*ua.InactivityTTL), time.UnixMilli(want))
+	}
+	ttl := *ua.InactivityTTL
+
+	// Repeated events for the same condition keep its TTL and the warning
+	ua.WarnedAt = &[]int64{time.Now().UnixMilli()}[0]
+	ua.UpdateRoutingStatus(apitypes.RoutingStatus{Status: "NOT_RESPONDING", StartTime: time.Now()})
+	ua.CheckInactivityConditions()
+	if *ua.InactivityTTL != ttl || ua.WarnedAt == nil {
+		t.Errorf("InactivityTTL = %v, warned at %v after a repeated event, want %v and the warning kept",
+			time.UnixMilli(*ua.InactivityTTL), ua.WarnedAt, time.UnixMilli(ttl))
+	}
+
+	// Losing the station as well doesn't move the earlier deadline
+	ua.UpdateStation(apitypes.StationEventBody{}, time.Now())
+	ua.CheckInactivityConditions()
+	if ua.Condition != "not responding" || *ua.InactivityTTL != ttl {
+		t.Errorf("Condition = %q, InactivityTTL = %v, want the not responding TTL kept", ua.Condition, time.UnixMilli(*ua.InactivityTTL))
+	}
+
+	// Once the user responds again, the station condition takes over
+	ua.UpdateRoutingStatus(apitypes.RoutingStatus{Status: "IDLE"})
+	ua.CheckInactivityConditions()
+	if ua.NotRespondingSince != nil || ua.Condition != "no station associated" {
+		t.Errorf("NotRespondingSince = %v, Condition = %q, want the no station condition", ua.NotRespondingSince, ua.Condition)
+	}
+
+	// With both conditions over, the exempt presence clears the TTL
+	ua.UpdateStation(apitypes.StationEventBody{AssociatedStation: &apitypes.UserStation{ID: "station"}}, time.Now())
+	ua.CheckInactivityConditions()
+	if ua.NoStationSince != nil || ua.Condition != "" || ua.InactivityTTL != nil {
+		t.Errorf("NoStationSince = %v, Condition = %q, InactivityTTL = %v, want no condition or TTL",
+			ua.NoStationSince, ua.Condition, ua.InactivityTTL)
+	}
+}
@@ -0,0 +1,259 @@
+package genesys
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+const (
+	defaultSecretName = "user-activity-monitor-client-credentials"
+	defaultRegion     = "us-east-1"
+	// defaultTokenLifetimeSeconds is used when the token response has no expires_in
+	defaultTokenLifetimeSeconds = 3600
+)
+
+// CredentialsProvider provides the access token used to authorize API requests
+type CredentialsProvider interface {
+	// AccessToken returns a valid access token, getting a new one if needed
+	AccessToken(ctx context.Context) (string, error)
+	// Invalidate discards the access token after the API rejected it
+	Invalidate(accessToken string)
+}
+
+// ClientCredentials are the OAuth client credentials used to get an access token
+type ClientCredentials struct {
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+}
+
+// SecretSource loads the OAuth client credentials
+type SecretSource interface {
+	ClientCredentials(ctx context.Context) (ClientCredentials, error)
+}
+
+// StaticSecret is a SecretSource for fixed client credentials
+type StaticSecret ClientCredentials
+
+func (s StaticSecret) ClientCredentials(ctx context.Context) (ClientCredentials, error) {
+	return ClientCredentials(s), nil
+}
+
+// SecretsManagerSecret loads the client credentials from an AWS Secrets Manager secret
+type SecretsManagerSecret struct {
+	SecretName string
+	Region     string
+}
+
+func (s *SecretsManagerSecret) ClientCredentials(ctx context.Context) (ClientCredentials, error) {
+	var clientCredentials ClientCredentials
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(s.Region))
+	if err != nil {
+		return clientCredentials, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	// Create Secrets Manager client
+	svc := secretsmanager.NewFromConfig(cfg)
+
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(s.SecretName),
+		VersionStage: aws.String("AWSCURRENT"), // VersionStage defaults to AWSCURRENT if unspecified
+	}
+
+	result, err := svc.GetSecretValue(ctx, input)
+	if err != nil {
+		// For a list of exceptions thrown, see
+		// https://docs.aws.amazon.com/secretsmanager/latest/apireference/API_GetSecretValue.html
+		return clientCredentials, fmt.Errorf("failed to get client credentials secret: %w", err)
+	}
+
+	// Decrypts secret using the associated KMS key.
+	err = json.Unmarshal([]byte(aws.ToString(result.SecretString)), &clientCredentials)
+	if err != nil {
+		return clientCredentials, fmt.Errorf("failed to parse client credentials secret: %w", err)
+	}
+
+	return clientCredentials, nil
+}
+
+// tokenRefreshMargin is how long before it expires a cached access token is replaced
+const tokenRefreshMargin = 5 * time.Minute
+
+// ClientCredentialsProvider gets an access token with the OAuth client credentials grant. It is safe for concurrent
+// use. The client credentials are fetched on first use and again only when the login server rejects them (e.g. after
+// they were rotated). The token is cached until shortly before it expires.
+type ClientCredentialsProvider struct {
+	loginURL   string
+	httpClient *http.Client
+	secret     SecretSource
+
+	mu                sync.Mutex
+	clientCredentials *ClientCredentials
+	accessToken       string
+	refreshAt         time.Time
+}
+
+// credentialsRejectedError is returned when the login server rejects the client credentials
+type credentialsRejectedError struct {
+	statusCode int
+	body       string
+}
+
+func (e *credentialsRejectedError) Error() string {
+	return fmt.Sprintf("token request failed with status %d: %s", e.statusCode, e.body)
+}
+
+// NewClientCredentialsProvider creates a provider for the login server at loginURL (e.g. https://login.mypurecloud.com)
+func NewClientCredentialsProvider(loginURL string, httpClient *http.Client, secret SecretSource) *ClientCredentialsProvider {
+	return &ClientCredentialsProvider{
+		loginURL:   strings.TrimSuffix(loginURL, "/"),
+		httpClient: httpClient,
+		secret:     secret,
+	}
+}
+
+func (p *ClientCredentialsProvider) AccessToken(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.accessToken != "" && time.Now().Before(p.refreshAt) {
+		return p.accessToken, nil
+	}
+
+	// Fetch the client credentials on first use
+	if p.clientCredentials == nil {
+		if err := p.loadClientCredentials(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	token, expiresIn, err := p.getAccessToken(ctx, *p.clientCredentials)
+	var rejected *credentialsRejectedError
+	if errors.As(err, &rejected) {
+		// The credentials may have been rotated, fetch them again and retry once
+		fmt.Printf("client credentials were rejected, reloading them: %v\n", err)
+		if err := p.loadClientCredentials(ctx); err != nil {
+			return "", err
+		}
+		token, expiresIn, err = p.getAccessToken(ctx, *p.clientCredentials)
+	}
+	if err != nil {
+		p.accessToken = ""
+		return "", err
+	}
+
+	// Refresh the token shortly before it expires
+	lifetime := time.Duration(expiresIn) * time.Second
+	margin := tokenRefreshMargin
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	p.accessToken = token
+	p.refreshAt = time.Now().Add(lifetime - margin)
+
+	return p.accessToken, nil
+}
+
+func (p *ClientCredentialsProvider) Invalidate(accessToken string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Only discard the token if it hasn't already been replaced by another request
+	if p.accessToken == accessToken {
+		p.accessToken = ""
+	}
+}
+
+func (p *ClientCredentialsProvider) loadClientCredentials(ctx context.Context) error {
+	clientCredentials, err := p.secret.ClientCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	p.clientCredentials = &clientCredentials
+	return nil
+}
+
+// getAccessToken requests an access token and returns it with its lifetime in seconds
+func (p *ClientCredentialsProvider) getAccessToken(ctx context.Context, clientCredentials ClientCredentials) (string, int, error) {
+	// Prepare token request data
+	tokenData := map[string]string{
+		"grant_type": "client_credentials",
+	}
+
+	// Convert to form data
+	formData := ""
+	for key, value := range tokenData {
+		if formData != "" {
+			formData += "&"
+		}
+		formData += key + "=" + value
+	}
+
+	// Create token request with form data
+	req, err := http.NewRequestWithContext(ctx, "POST", p.loginURL+"/oauth/token", strings.NewReader(formData))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create token request: %w", err)
+	}
+
+	// Set headers for basic auth
+	credentials := fmt.Sprintf("%s:%s", clientCredentials.ClientID, clientCredentials.ClientSecret)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Make the request
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to make token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusBadRequest {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", 0, &credentialsRejectedError{statusCode: resp.StatusCode, body: string(bodyBytes)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", 0, fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	// Read response body
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read token response: %w", err)
+	}
+
+	// Parse token response
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	err = json.Unmarshal(bodyBytes, &tokenResp)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse token response: %w", err)
+	}
+
+	if tokenResp.AccessToken == "" {
+		return "", 0, fmt.Errorf("no access token received")
+	}
+
+	if tokenResp.ExpiresIn <= 0 {
+		tokenResp.ExpiresIn = defaultTokenLifetimeSeconds
+	}
+
+	return tokenResp.AccessToken, tokenResp.ExpiresIn, nil
+}
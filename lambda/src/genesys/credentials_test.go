@@ -0,0 +1,300 @@
+package genesys
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// loginServer is a fake login server handing out numbered access tokens to the accepted client secret
+type loginServer struct {
+	*httptest.Server
+	acceptSecret atomic.Value
+	expiresIn    int
+	delay        time.Duration
+	requests     atomic.Int32
+}
+
+func newLoginServer(t *testing.T, acceptSecret string, expiresIn int) *loginServer {
+	s := &loginServer{expiresIn: expiresIn}
+	s.acceptSecret.Store(acceptSecret)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := s.requests.Add(1)
+		time.Sleep(s.delay)
+
+		if r.Method != http.MethodPost || r.URL.Path != "/oauth/token" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_, secret, ok := r.BasicAuth()
+		if !ok || secret != s.acceptSecret.Load().(string) {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", n),
+			"token_type":   "bearer",
+			"expires_in":   s.expiresIn,
+		})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// rotatingSecret is a SecretSource returning the current secret and counting the loads
+type rotatingSecret struct {
+	secret atomic.Value
+	loads  atomic.Int32
+}
+
+func newRotatingSecret(secret string) *rotatingSecret {
+	s := &rotatingSecret{}
+	s.secret.Store(secret)
+	return s
+}
+
+func (s *rotatingSecret) ClientCredentials(ctx context.Context) (ClientCredentials, error) {
+	s.loads.Add(1)
+	return ClientCredentials{ClientID: "client", ClientSecret: s.secret.Load().(string)}, nil
+}
+
+func TestAccessTokenIsCached(t *testing.T) {
+	login := newLoginServer(t, "secret", 3600)
+	secret := newRotatingSecret("secret")
+	provider := NewClientCredentialsProvider(login.URL, login.Client(), secret)
+
+	for i := 0; i < 3; i++ {
+		token, err := provider.AccessToken(context.Background())
+		if err != nil {
+			t.Fatalf("AccessToken: %v", err)
+		}
+		if token != "token-1" {
+			t.Errorf("token = %q, want token-1", token)
+		}
+	}
+	if n := login.requests.Load(); n != 1 {
+		t.Errorf("token requests = %d, want 1", n)
+	}
+	if n := secret.loads.Load(); n != 1 {
+		t.Errorf("secret loads = %d, want 1", n)
+	}
+}
+
+func TestAccessTokenIsRefreshedBeforeExpiry(t *testing.T) {
+	// A 2 second token is refreshed after half its lifetime
+	login := newLoginServer(t, "secret", 2)
+	secret := newRotatingSecret("secret")
+	provider := NewClientCredentialsProvider(login.URL, login.Client(), secret)
+
+	token, err := provider.AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	if token != "token-1" {
+		t.Fatalf("token = %q, want token-1", token)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	token, err = provider.AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	if token != "token-2" {
+		t.Errorf("token after refresh margin = %q, want token-2", token)
+	}
+	if n := secret.loads.Load(); n != 1 {
+		t.Errorf("secret loads = %d, want 1", n)
+	}
+}
+
+func TestAccessTokenReloadsRejectedSecret(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+	}{
+		{name: "unauthorized", statusCode: http.StatusUnauthorized},
+		{name: "bad request", statusCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			login := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				if _, secret, _ := r.BasicAuth(); secret != "rotated" {
+					http.Error(w, `{"error":"invalid_client"}`, tt.statusCode)
+					return
+				}
+				fmt.Fprint(w, `{"access_token":"new-token","expires_in":3600}`)
+			}))
+			defer login.Close()
+
+			// The secret is rotated after the provider first loaded it
+			secret := newRotatingSecret("old")
+			provider := NewClientCredentialsProvider(login.URL, login.Client(), secret)
+			if _, err := provider.AccessToken(context.Background()); err == nil {
+				t.Fatal("AccessToken with the old secret succeeded, want an error")
+			}
+			secret.secret.Store("rotated")
+			loads := secret.loads.Load()
+			requests.Store(0)
+
+			token, err := provider.AccessToken(context.Background())
+			if err != nil {
+				t.Fatalf("AccessToken: %v", err)
+			}
+			if token != "new-token" {
+				t.Errorf("token = %q, want new-token", token)
+			}
+			if n := secret.loads.Load() - loads; n != 1 {
+				t.Errorf("secret reloads = %d, want 1", n)
+			}
+			if n := requests.Load(); n != 2 {
+				t.Errorf("token requests = %d, want 2 (rejected, then retried)", n)
+			}
+		})
+	}
+}
+
+func TestAccessTokenGivesUpAfterOneReload(t *testing.T) {
+	login := newLoginServer(t, "secret", 3600)
+	secret := newRotatingSecret("wrong")
+	provider := NewClientCredentialsProvider(login.URL, login.Client(), secret)
+
+	if _, err := provider.AccessToken(context.Background()); err == nil {
+		t.Fatal("AccessToken succeeded, want an error")
+	}
+	if n := login.requests.Load(); n != 2 {
+		t.Errorf("token requests = %d, want 2", n)
+	}
+	if n := secret.loads.Load(); n != 2 {
+		t.Errorf("secret loads = %d, want 2", n)
+	}
+}
+
+func TestAccessTokenConcurrentCalls(t *testing.T) {
+	login := newLoginServer(t, "secret", 3600)
+	login.delay = 50 * time.Millisecond
+	provider := NewClientCredentialsProvider(login.URL, login.Client(), newRotatingSecret("secret"))
+
+	const callers = 20
+	var wg sync.WaitGroup
+	tokens := make([]string, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = provider.AccessToken(context.Background())
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil {
+			t.Errorf("caller %d: %v", i, errs[i])
+		} else if tokens[i] != "token-1" {
+			t.Errorf("caller %d: token = %q, want token-1", i, tokens[i])
+		}
+	}
+	if n := login.requests.Load(); n != 1 {
+		t.Errorf("token requests = %d, want 1", n)
+	}
+}
+
+func TestInvalidateKeepsReplacedToken(t *testing.T) {
+	login := newLoginServer(t, "secret", 3600)
+	provider := NewClientCredentialsProvider(login.URL, login.Client(), newRotatingSecret("secret"))
+
+	token, err := provider.AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	provider.Invalidate(token)
+	replaced, err := provider.AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+
+	// A late Invalidate of the first token must not discard its replacement
+	provider.Invalidate(token)
+	current, err := provider.AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	if current != replaced {
+		t.Errorf("token = %q, want %q", current, replaced)
+	}
+	if n := login.requests.Load(); n != 2 {
+		t.Errorf("token requests = %d, want 2", n)
+	}
+}
+
+func TestAPIClientRetriesRejectedToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		rejectTokens map[string]bool
+		wantErr      bool
+		wantRequests int32
+	}{
+		{
+			name:         "new token accepted",
+			rejectTokens: map[string]bool{"token-1": true},
+			wantRequests: 2,
+		},
+		{
+			name:         "new token rejected as well",
+			rejectTokens: map[string]bool{"token-1": true, "token-2": true},
+			wantErr:      true,
+			wantRequests: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login := newLoginServer(t, "secret", 3600)
+			provider := NewClientCredentialsProvider(login.URL, login.Client(), newRotatingSecret("secret"))
+
+			var requests atomic.Int32
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				token := r.Header.Get("Authorization")[len("Bearer "):]
+				if tt.rejectTokens[token] {
+					http.Error(w, `{"code":"bad.credentials"}`, http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprint(w, `{"id":"user-1","name":"User One"}`)
+			}))
+			defer api.Close()
+
+			client := NewAPIClient(api.URL, api.Client(), provider)
+			user, err := client.GetUser(context.Background(), "user-1")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("GetUser succeeded, want an error")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("GetUser: %v", err)
+				}
+				if user.ID != "user-1" {
+					t.Errorf("user ID = %q, want user-1", user.ID)
+				}
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("API requests = %d, want %d", n, tt.wantRequests)
+			}
+			if n := login.requests.Load(); n != 2 {
+				t.Errorf("token requests = %d, want 2", n)
+			}
+		})
+	}
+}
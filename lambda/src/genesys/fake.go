@@ -0,0 +1,111 @@
+package genesys
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// FakeClient is an in-memory Client for running the handlers offline
+type FakeClient struct {
+	mu sync.Mutex
+
+	Users     map[string]*GenesysUser
+	Presences map[string]GenesysPresence
+
+	// LogoutErrors makes LogoutUser fail for the user IDs
+	LogoutErrors map[string]error
+	// LoggedOut records the user IDs that were logged out
+	LoggedOut []string
+	// SetPresences and SetRoutingStatuses record the presence and routing status set for each user ID
+	SetPresences       map[string]string
+	SetRoutingStatuses map[string]string
+}
+
+func NewFakeClient() *FakeClient {
+	return &FakeClient{
+		Users:              make(map[string]*GenesysUser),
+		Presences:          make(map[string]GenesysPresence),
+		LogoutErrors:       make(map[string]error),
+		SetPresences:       make(map[string]string),
+		SetRoutingStatuses: make(map[string]string),
+	}
+}
+
+func (c *FakeClient) GetUser(ctx context.Context, userID string) (*GenesysUser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	user, ok := c.Users[userID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get Genesys user: user %s not found", userID)
+	}
+	return user, nil
+}
+
+func (c *FakeClient) GetUsers(ctx context.Context, userIDs []string) (map[string]*GenesysUser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	users := make(map[string]*GenesysUser)
+	for _, userID := range userIDs {
+		if user, ok := c.Users[userID]; ok {
+			users[userID] = user
+		}
+	}
+	return users, nil
+}
+
+func (c *FakeClient) GetGroupMembers(ctx context.Context, groupID string) ([]GenesysUser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var members []GenesysUser
+	for _, user := range c.Users {
+		for _, group := range user.Groups {
+			if group.ID == groupID {
+				members = append(members, *user)
+				break
+			}
+		}
+	}
+	return members, nil
+}
+
+func (c *FakeClient) GetPresences(ctx context.Context) (map[string]GenesysPresence, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	presences := make(map[string]GenesysPresence)
+	for id, presence := range c.Presences {
+		presences[id] = presence
+	}
+	return presences, nil
+}
+
+func (c *FakeClient) LogoutUser(ctx context.Context, userID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err, ok := c.LogoutErrors[userID]; ok {
+		return err
+	}
+	c.LoggedOut = append(c.LoggedOut, userID)
+	return nil
+}
+
+func (c *FakeClient) SetPresence(ctx context.Context, userID string, systemPresence string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.SetPresences[userID] = systemPresence
+	return nil
+}
+
+func (c *FakeClient) SetRoutingStatus(ctx context.Context, userID string, status string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.SetRoutingStatuses[userID] = status
+	return nil
+}
@@ -1,82 +1,103 @@
 package genesys
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 )
 
-type clientCredentials struct {
-	ClientID     string `json:"clientId"`
-	ClientSecret string `json:"clientSecret"`
+// Client provides access to the Genesys Cloud API
+type Client interface {
+	GetUser(ctx context.Context, userID string) (*GenesysUser, error)
+	GetUsers(ctx context.Context, userIDs []string) (map[string]*GenesysUser, error)
+	// GetGroupMembers returns every member of the group, with their groups, presence, conversation summary, routing
+	// status and station
+	GetGroupMembers(ctx context.Context, groupID string) ([]GenesysUser, error)
+	GetPresences(ctx context.Context) (map[string]GenesysPresence, error)
+	LogoutUser(ctx context.Context, userID string) error
+	// SetPresence sets the user's presence to the primary presence definition of the system presence (e.g. Offline)
+	SetPresence(ctx context.Context, userID string, systemPresence string) error
+	SetRoutingStatus(ctx context.Context, userID string, status string) error
 }
 
-var accessToken string
-var genesysAPIDomain string = os.Getenv("GENESYS_API_DOMAIN")
-
+// System presences and routing statuses set by the reaper
 const (
-	secretName = "user-activity-monitor-client-credentials"
-	region     = "us-east-1"
+	SystemPresenceOffline = "Offline"
+	SystemPresenceAway    = "Away"
+	RoutingStatusOffQueue = "OFF_QUEUE"
 )
 
-func init() {
-	Reauth()
-}
+// RoutingStatusNotResponding is the routing status of an On Queue user who didn't answer an alerting interaction
+const RoutingStatusNotResponding = "NOT_RESPONDING"
 
-func Reauth() error {
-	config, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
-	if err != nil {
-		log.Fatal(err)
-	}
+// APIClient is the Client implementation for the Genesys Cloud REST API
+type APIClient struct {
+	baseURL     string
+	httpClient  *http.Client
+	credentials CredentialsProvider
+	limiter     *RateLimiter
 
-	// Create Secrets Manager client
-	svc := secretsmanager.NewFromConfig(config)
+	// presenceIDs caches the primary presence definition ID of each system presence
+	presenceMu  sync.Mutex
+	presenceIDs map[string]string
+}
 
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId:     aws.String(secretName),
-		VersionStage: aws.String("AWSCURRENT"), // VersionStage defaults to AWSCURRENT if unspecified
+// NewAPIClient creates a client for the API at baseURL (e.g. https://api.mypurecloud.com)
+func NewAPIClient(baseURL string, httpClient *http.Client, credentials CredentialsProvider) *APIClient {
+	return &APIClient{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		httpClient:  httpClient,
+		credentials: credentials,
+		limiter:     NewRateLimiter(defaultRequestsPerSecond, defaultRequestBurst),
 	}
+}
 
-	result, err := svc.GetSecretValue(context.TODO(), input)
-	if err != nil {
-		// For a list of exceptions thrown, see
-		// https://docs.aws.amazon.com/secretsmanager/latest/apireference/API_GetSecretValue.html
-		log.Fatal(err.Error())
-	}
+// SetRateLimiter replaces the limiter shared by the requests of the client
+func (c *APIClient) SetRateLimiter(limiter *RateLimiter) {
+	c.limiter = limiter
+}
 
-	// Decrypts secret using the associated KMS key.
-	var secretString string = *result.SecretString
-	var clientCredentials clientCredentials
-	err = json.Unmarshal([]byte(secretString), &clientCredentials)
-	if err != nil {
-		log.Fatal(err)
+// NewClientFromEnv creates a client for the GENESYS_API_DOMAIN region, authenticated with the client credentials stored
+// in the GENESYS_CREDENTIALS_SECRET_NAME secret
+func NewClientFromEnv() *APIClient {
+	apiDomain := os.Getenv("GENESYS_API_DOMAIN")
+	secretName := os.Getenv("GENESYS_CREDENTIALS_SECRET_NAME")
+	if secretName == "" {
+		secretName = defaultSecretName
 	}
 
-	// Get access token
-	accessToken, err = getAccessToken(clientCredentials)
-	if err != nil {
-		log.Fatal(err)
+	httpClient := &http.Client{
+		Timeout: 16 * time.Second,
 	}
 
-	return nil
+	credentials := NewClientCredentialsProvider(
+		fmt.Sprintf("https://login.%s", apiDomain),
+		&http.Client{
+			Timeout: 30 * time.Second,
+		},
+		&SecretsManagerSecret{
+			SecretName: secretName,
+			Region:     defaultRegion,
+		},
+	)
+
+	client := NewAPIClient(fmt.Sprintf("https://api.%s", apiDomain), httpClient, credentials)
+	client.SetRateLimiter(NewRateLimiterFromEnv())
+	return client
 }
 
-func GetUser(userID string) (*GenesysUser, error) {
+func (c *APIClient) GetUser(ctx context.Context, userID string) (*GenesysUser, error) {
 	var response GenesysUser
 
-	err := apiGet(fmt.Sprintf("/api/v2/users/%s?expand=groups,presence,conversationSummary", url.QueryEscape(userID)), &response)
+	err := c.apiGet(ctx, fmt.Sprintf("/api/v2/users/%s?expand=groups,presence,conversationSummary,routingStatus,station", url.QueryEscape(userID)), &response)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Genesys user: %w", err)
 	}
@@ -84,7 +105,7 @@ func GetUser(userID string) (*GenesysUser, error) {
 	return &response, nil
 }
 
-func GetUsers(userIDs []string) (map[string]*GenesysUser, error) {
+func (c *APIClient) GetUsers(ctx context.Context, userIDs []string) (map[string]*GenesysUser, error) {
 	// Create map of users
 	users := make(map[string]*GenesysUser)
 
@@ -105,7 +126,7 @@ func GetUsers(userIDs []string) (map[string]*GenesysUser, error) {
 
 		// Get users for this batch
 		var response genesysUserResponse
-		err := apiGet(fmt.Sprintf("/api/v2/users?id=%s&pageSize=500", url.QueryEscape(ids)), &response)
+		err := c.apiGet(ctx, fmt.Sprintf("/api/v2/users?id=%s&pageSize=500&expand=groups,presence,conversationSummary,routingStatus,station", url.QueryEscape(ids)), &response)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get Genesys users for batch %d-%d: %w", i+1, end, err)
 		}
@@ -119,9 +140,28 @@ func GetUsers(userIDs []string) (map[string]*GenesysUser, error) {
 	return users, nil
 }
 
-func GetPresences() (map[string]GenesysPresence, error) {
+func (c *APIClient) GetGroupMembers(ctx context.Context, groupID string) ([]GenesysUser, error) {
+	// Members are paged, 100 per page is the API maximum
+	const pageSize = 100
+
+	var members []GenesysUser
+	for pageNumber := 1; ; pageNumber++ {
+		var response genesysUserResponse
+		err := c.apiGet(ctx, fmt.Sprintf("/api/v2/groups/%s/members?pageSize=%d&pageNumber=%d&expand=groups,presence,conversationSummary,routingStatus,station", url.PathEscape(groupID), pageSize, pageNumber), &response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get members of Genesys group %s, page %d: %w", groupID, pageNumber, err)
+		}
+
+		members = append(members, response.Entities...)
+		if pageNumber >= response.PageCount || len(response.Entities) == 0 {
+			return members, nil
+		}
+	}
+}
+
+func (c *APIClient) GetPresences(ctx context.Context) (map[string]GenesysPresence, error) {
 	var response genesysPresenceResponse
-	err := apiGet("/api/v2/presence/definitions", &response)
+	err := c.apiGet(ctx, "/api/v2/presence/definitions", &response)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Genesys presences: %w", err)
 	}
@@ -135,27 +175,13 @@ func GetPresences() (map[string]GenesysPresence, error) {
 	return presenceMap, nil
 }
 
-func LogoutUser(userID string) error {
+func (c *APIClient) LogoutUser(ctx context.Context, userID string) error {
 	fmt.Printf("Logging out Genesys user: %s\n", userID)
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 16 * time.Second,
-	}
-
-	// Create request
-	url := fmt.Sprintf("https://api.%s/api/v2/tokens/%s", genesysAPIDomain, url.PathEscape(userID))
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	// Set headers
-	req.Header.Set("Authorization", "Bearer "+accessToken)
 
 	// Make the request
-	resp, err := client.Do(req)
+	resp, err := c.do(ctx, "DELETE", fmt.Sprintf("/api/v2/tokens/%s", url.PathEscape(userID)), nil)
 	if err != nil {
-		return fmt.Errorf("failed to make request: %w", err)
+		return err
 	}
 	defer resp.Body.Close()
 
@@ -168,121 +194,193 @@ func LogoutUser(userID string) error {
 	return nil
 }
 
-func apiGet(urlPath string, response interface{}) error {
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 16 * time.Second,
-	}
+// do makes an authorized, rate limited API request. If the access token is rejected, it is discarded and the request is
+// retried once with a new token. Throttled requests and server errors are retried up to maxRetries times.
+func (c *APIClient) do(ctx context.Context, method string, urlPath string, body []byte) (*http.Response, error) {
+	reauthed := false
+	retries := 0
+	for {
+		if err := spendRequestBudget(ctx); err != nil {
+			return nil, err
+		}
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("failed to wait for rate limiter: %w", err)
+		}
 
-	// ensure path starts with /
-	if !strings.HasPrefix(urlPath, "/") {
-		urlPath = "/" + urlPath
-	}
+		req, accessToken, err := c.newRequest(ctx, method, urlPath, body)
+		if err != nil {
+			return nil, err
+		}
 
-	// Create request
-	url := fmt.Sprintf("https://api.%s%s", genesysAPIDomain, urlPath)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to make request: %w", err)
+		}
+		c.limiter.observe(resp.Header)
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && !reauthed:
+			fmt.Printf("Access token was rejected for %s %s, retrying with a new token\n", method, urlPath)
+			resp.Body.Close()
+			c.credentials.Invalidate(accessToken)
+			reauthed = true
+		case isRetryableStatus(resp.StatusCode) && retries < maxRetries:
+			delay := retryDelay(resp, retries)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusTooManyRequests {
+				// Hold back the other requests of the client as well
+				c.limiter.PauseUntil(time.Now().Add(delay))
+			}
+			fmt.Printf("%s %s failed with status %d, retrying in %v\n", method, urlPath, resp.StatusCode, delay)
+			if err := sleep(ctx, delay); err != nil {
+				return nil, fmt.Errorf("failed to retry request after status %d: %w", resp.StatusCode, err)
+			}
+			retries++
+		default:
+			return resp, nil
+		}
 	}
+}
 
-	// Set headers
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("Content-Type", "application/json")
+func (c *APIClient) SetPresence(ctx context.Context, userID string, systemPresence string) error {
+	fmt.Printf("Setting presence of Genesys user %s to %s\n", userID, systemPresence)
 
-	// Make the request
-	resp, err := client.Do(req)
+	presenceID, err := c.presenceDefinitionID(ctx, systemPresence)
 	if err != nil {
-		return fmt.Errorf("failed to make request: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	body := map[string]interface{}{
+		"presenceDefinition": map[string]string{
+			"id": presenceID,
+		},
 	}
-
-	// Read response body
-	bodyBytes, err := io.ReadAll(resp.Body)
+	err = c.apiSend(ctx, "PATCH", fmt.Sprintf("/api/v2/users/%s/presences/purecloud", url.PathEscape(userID)), body)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		return fmt.Errorf("failed to set Genesys presence: %w", err)
 	}
 
-	// Parse response
-	err = json.Unmarshal(bodyBytes, &response)
+	return nil
+}
+
+func (c *APIClient) SetRoutingStatus(ctx context.Context, userID string, status string) error {
+	fmt.Printf("Setting routing status of Genesys user %s to %s\n", userID, status)
+
+	body := map[string]string{
+		"status": status,
+	}
+	err := c.apiSend(ctx, "PUT", fmt.Sprintf("/api/v2/users/%s/routingstatus", url.PathEscape(userID)), body)
 	if err != nil {
-		return fmt.Errorf("failed to parse response: %w", err)
+		return fmt.Errorf("failed to set Genesys routing status: %w", err)
 	}
 
 	return nil
 }
 
-func getAccessToken(clientCredentials clientCredentials) (string, error) {
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// presenceDefinitionID finds the primary (system) presence definition for the system presence
+func (c *APIClient) presenceDefinitionID(ctx context.Context, systemPresence string) (string, error) {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+
+	if c.presenceIDs == nil {
+		presences, err := c.GetPresences(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		c.presenceIDs = make(map[string]string)
+		for _, presence := range presences {
+			if presence.Deactivated || !strings.EqualFold(presence.Type, "System") {
+				continue
+			}
+			c.presenceIDs[strings.ToLower(presence.SystemPresence)] = presence.ID
+		}
+	}
+
+	presenceID, ok := c.presenceIDs[strings.ToLower(systemPresence)]
+	if !ok {
+		return "", fmt.Errorf("no presence definition found for system presence %s", systemPresence)
+	}
+	return presenceID, nil
+}
+
+// newRequest creates an authorized API request and returns it with the access token it uses
+func (c *APIClient) newRequest(ctx context.Context, method string, urlPath string, body []byte) (*http.Request, string, error) {
+	// ensure path starts with /
+	if !strings.HasPrefix(urlPath, "/") {
+		urlPath = "/" + urlPath
 	}
 
-	// Prepare token request data
-	tokenData := map[string]string{
-		"grant_type": "client_credentials",
+	accessToken, err := c.credentials.AccessToken(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get access token: %w", err)
 	}
 
-	// Convert to form data
-	formData := ""
-	for key, value := range tokenData {
-		if formData != "" {
-			formData += "&"
-		}
-		formData += key + "=" + value
+	// Create request
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
 	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+urlPath, bodyReader)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	return req, accessToken, nil
+}
 
-	// Create token request with form data
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://login.%s/oauth/token", genesysAPIDomain), strings.NewReader(formData))
+// apiSend sends the request body as JSON and checks for a successful response
+func (c *APIClient) apiSend(ctx context.Context, method string, urlPath string, body interface{}) error {
+	bodyBytes, err := json.Marshal(body)
 	if err != nil {
-		return "", fmt.Errorf("failed to create token request: %w", err)
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	// Make the request
+	resp, err := c.do(ctx, method, urlPath, bodyBytes)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(respBytes))
 	}
 
-	// Set headers for basic auth
-	credentials := fmt.Sprintf("%s:%s", clientCredentials.ClientID, clientCredentials.ClientSecret)
-	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return nil
+}
 
+func (c *APIClient) apiGet(ctx context.Context, urlPath string, response interface{}) error {
 	// Make the request
-	resp, err := client.Do(req)
+	resp, err := c.do(ctx, "GET", urlPath, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to make token request: %w", err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
 	}
 
 	// Read response body
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read token response: %w", err)
-	}
-
-	// Parse token response
-	var tokenResp struct {
-		AccessToken string `json:"access_token"`
-		TokenType   string `json:"token_type"`
-		ExpiresIn   int    `json:"expires_in"`
+		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	err = json.Unmarshal(bodyBytes, &tokenResp)
+	// Parse response
+	err = json.Unmarshal(bodyBytes, &response)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse token response: %w", err)
-	}
-
-	if tokenResp.AccessToken == "" {
-		return "", fmt.Errorf("no access token received")
+		return fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	return tokenResp.AccessToken, nil
+	return nil
 }
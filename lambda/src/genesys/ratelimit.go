@@ -0,0 +1,210 @@
+package genesys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * All API requests go through APIClient.do, which:
+ * - waits for a token from a shared token-bucket RateLimiter, so concurrent callers stay under the org's rate limit
+ * - pauses the limiter when the inin-ratelimit-* headers report that the limit is used up
+ * - retries 429 and 5xx responses with jittered backoff, honoring Retry-After
+ * - spends the per-invocation request budget set with WithRequestBudget
+ * No wait is started that would outlast the context deadline, the request fails instead so the caller can finish up.
+ */
+
+const (
+	defaultRequestsPerSecond = 5
+	defaultRequestBurst      = 5
+	maxRetries               = 3
+	baseRetryDelay           = 500 * time.Millisecond
+	maxRetryDelay            = 30 * time.Second
+)
+
+// ErrRequestBudgetExhausted is returned when the request budget of the invocation is used up
+var ErrRequestBudgetExhausted = errors.New("genesys API request budget exhausted")
+
+// RateLimiter is a token bucket shared by all requests of a client. It is safe for concurrent use.
+type RateLimiter struct {
+	mu          sync.Mutex
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// NewRateLimiter creates a limiter allowing ratePerSecond requests on average and bursts of up to burst requests
+func NewRateLimiter(ratePerSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:   ratePerSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a request is allowed
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		var wait time.Duration
+		if now.Before(l.pausedUntil) {
+			wait = l.pausedUntil.Sub(now)
+		} else {
+			// Refill the bucket for the time elapsed since the last request
+			l.tokens += now.Sub(l.last).Seconds() * l.rate
+			if l.tokens > l.burst {
+				l.tokens = l.burst
+			}
+			l.last = now
+
+			if l.tokens >= 1 {
+				l.tokens--
+				l.mu.Unlock()
+				return nil
+			}
+			wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		}
+		l.mu.Unlock()
+
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// PauseUntil holds back all requests until t
+func (l *RateLimiter) PauseUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.pausedUntil) {
+		l.pausedUntil = t
+	}
+}
+
+// observe pauses the limiter when the rate limit headers of a response show the limit is used up
+func (l *RateLimiter) observe(header http.Header) {
+	count, err1 := strconv.Atoi(header.Get("inin-ratelimit-count"))
+	allowed, err2 := strconv.Atoi(header.Get("inin-ratelimit-allowed"))
+	reset, err3 := strconv.Atoi(header.Get("inin-ratelimit-reset"))
+	if err1 != nil || err2 != nil || err3 != nil || allowed <= 0 {
+		return
+	}
+
+	if count >= allowed {
+		fmt.Printf("Genesys rate limit used up (%d/%d), pausing requests for %d seconds\n", count, allowed, reset)
+		l.PauseUntil(time.Now().Add(time.Duration(reset) * time.Second))
+	}
+}
+
+// NewRateLimiterFromEnv creates a limiter with the GENESYS_REQUESTS_PER_SECOND rate and GENESYS_REQUEST_BURST burst
+func NewRateLimiterFromEnv() *RateLimiter {
+	return NewRateLimiter(
+		float64(envInt("GENESYS_REQUESTS_PER_SECOND", defaultRequestsPerSecond)),
+		envInt("GENESYS_REQUEST_BURST", defaultRequestBurst),
+	)
+}
+
+type requestBudgetKey struct{}
+
+// WithRequestBudget limits the number of API requests (including retries) made with ctx. A budget of 0 or less means
+// no limit.
+func WithRequestBudget(ctx context.Context, requests int) context.Context {
+	if requests <= 0 {
+		return ctx
+	}
+	remaining := &atomic.Int64{}
+	remaining.Store(int64(requests))
+	return context.WithValue(ctx, requestBudgetKey{}, remaining)
+}
+
+// RequestBudgetFromEnv returns the per-invocation request budget from GENESYS_REQUEST_BUDGET, 0 if not set
+func RequestBudgetFromEnv() int {
+	return envInt("GENESYS_REQUEST_BUDGET", 0)
+}
+
+// spendRequestBudget takes one request from the budget of ctx
+func spendRequestBudget(ctx context.Context) error {
+	remaining, ok := ctx.Value(requestBudgetKey{}).(*atomic.Int64)
+	if !ok {
+		return nil
+	}
+	if remaining.Add(-1) < 0 {
+		return ErrRequestBudgetExhausted
+	}
+	return nil
+}
+
+// isRetryableStatus returns true for throttled requests and server errors
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// retryDelay returns how long to wait before retrying a response. Retry-After is honored when present, otherwise the
+// delay grows exponentially with the attempt. Both are jittered so concurrent callers don't retry in lockstep.
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	if delay, ok := retryAfter(resp.Header); ok {
+		return delay + time.Duration(rand.Int63n(int64(baseRetryDelay)))
+	}
+
+	delay := baseRetryDelay << attempt
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter reads the Retry-After header (seconds or HTTP date), falling back to inin-ratelimit-reset
+func retryAfter(header http.Header) (time.Duration, bool) {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if t, err := http.ParseTime(value); err == nil {
+			return time.Until(t), true
+		}
+	}
+	if seconds, err := strconv.Atoi(header.Get("inin-ratelimit-reset")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// sleep waits for d, failing right away if the context would expire first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(d).After(deadline) {
+		return fmt.Errorf("waiting %v would exceed the deadline: %w", d, context.DeadlineExceeded)
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// envInt reads a positive integer from the environment, or returns the default
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
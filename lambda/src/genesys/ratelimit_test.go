@@ -0,0 +1,358 @@
+package genesys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// staticToken is a CredentialsProvider that always returns the same access token
+type staticToken string
+
+func (s staticToken) AccessToken(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+func (s staticToken) Invalidate(accessToken string) {}
+
+// newStatusServer serves the given statuses in order, repeating the last one, with the headers set by header
+func newStatusServer(t *testing.T, statuses []int, header func(h http.Header)) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		status := statuses[len(statuses)-1]
+		if n <= len(statuses) {
+			status = statuses[n-1]
+		}
+		if header != nil {
+			header(w.Header())
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"id":"user-1"}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func newTestAPIClient(server *httptest.Server) *APIClient {
+	client := NewAPIClient(server.URL, server.Client(), staticToken("token"))
+	client.SetRateLimiter(NewRateLimiter(1000, 1000))
+	return client
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter := NewRateLimiter(20, 2)
+	ctx := context.Background()
+
+	// The burst is allowed right away
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := limiter.Wait(ctx); err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("burst took %v, want no wait", elapsed)
+	}
+
+	// The next request waits for the bucket to refill at 20 per second
+	start = time.Now()
+	if err := limiter.Wait(ctx); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("request after the burst waited %v, want about 50ms", elapsed)
+	}
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	limiter := NewRateLimiter(1000, 1000)
+	limiter.PauseUntil(time.Now().Add(100 * time.Millisecond))
+	// An earlier pause doesn't shorten the current one
+	limiter.PauseUntil(time.Now())
+
+	start := time.Now()
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Wait during pause took %v, want about 100ms", elapsed)
+	}
+}
+
+func TestRateLimiterWaitPastDeadline(t *testing.T) {
+	limiter := NewRateLimiter(1000, 1000)
+	limiter.PauseUntil(time.Now().Add(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := limiter.Wait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Wait took %v, want to fail right away", elapsed)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    map[string]string
+		wantPause time.Duration
+	}{
+		{
+			name:      "limit used up",
+			header:    map[string]string{"inin-ratelimit-count": "300", "inin-ratelimit-allowed": "300", "inin-ratelimit-reset": "30"},
+			wantPause: 30 * time.Second,
+		},
+		{
+			name:   "limit not used up",
+			header: map[string]string{"inin-ratelimit-count": "299", "inin-ratelimit-allowed": "300", "inin-ratelimit-reset": "30"},
+		},
+		{
+			name:   "missing reset",
+			header: map[string]string{"inin-ratelimit-count": "300", "inin-ratelimit-allowed": "300"},
+		},
+		{
+			name:   "no rate limit headers",
+			header: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range tt.header {
+				header.Set(name, value)
+			}
+			limiter := NewRateLimiter(1000, 1000)
+			start := time.Now()
+			limiter.observe(header)
+
+			if tt.wantPause == 0 {
+				if !limiter.pausedUntil.IsZero() {
+					t.Errorf("paused until %v, want no pause", limiter.pausedUntil)
+				}
+				return
+			}
+			pause := limiter.pausedUntil.Sub(start)
+			if pause < tt.wantPause || pause > tt.wantPause+time.Second {
+				t.Errorf("paused for %v, want %v", pause, tt.wantPause)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    map[string]string
+		wantDelay time.Duration
+		wantOK    bool
+	}{
+		{
+			name:      "seconds",
+			header:    map[string]string{"Retry-After": "7"},
+			wantDelay: 7 * time.Second,
+			wantOK:    true,
+		},
+		{
+			name:      "zero seconds",
+			header:    map[string]string{"Retry-After": "0"},
+			wantDelay: 0,
+			wantOK:    true,
+		},
+		{
+			name:      "HTTP date",
+			header:    map[string]string{"Retry-After": time.Now().Add(2 * time.Minute).UTC().Format(http.TimeFormat)},
+			wantDelay: 2 * time.Minute,
+			wantOK:    true,
+		},
+		{
+			name:      "Retry-After takes precedence over the rate limit reset",
+			header:    map[string]string{"Retry-After": "7", "inin-ratelimit-reset": "30"},
+			wantDelay: 7 * time.Second,
+			wantOK:    true,
+		},
+		{
+			name:      "rate limit reset",
+			header:    map[string]string{"inin-ratelimit-reset": "30"},
+			wantDelay: 30 * time.Second,
+			wantOK:    true,
+		},
+		{
+			name:      "invalid Retry-After falls back to the rate limit reset",
+			header:    map[string]string{"Retry-After": "soon", "inin-ratelimit-reset": "30"},
+			wantDelay: 30 * time.Second,
+			wantOK:    true,
+		},
+		{
+			name:   "negative seconds",
+			header: map[string]string{"Retry-After": "-1"},
+		},
+		{
+			name:   "no headers",
+			header: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range tt.header {
+				header.Set(name, value)
+			}
+
+			delay, ok := retryAfter(header)
+			if ok != tt.wantOK {
+				t.Fatalf("retryAfter ok = %v, want %v", ok, tt.wantOK)
+			}
+			// HTTP dates have a 1 second resolution
+			if delay > tt.wantDelay || delay < tt.wantDelay-time.Second {
+				t.Errorf("retryAfter = %v, want %v", delay, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := retryDelay(&http.Response{Header: http.Header{}}, attempt)
+		maxDelay := baseRetryDelay << attempt
+		if maxDelay > maxRetryDelay {
+			maxDelay = maxRetryDelay
+		}
+		if delay < maxDelay/2 || delay > maxDelay {
+			t.Errorf("attempt %d: delay = %v, want between %v and %v", attempt, delay, maxDelay/2, maxDelay)
+		}
+	}
+}
+
+func TestAPIClientRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantErr      bool
+		wantRequests int32
+	}{
+		{
+			name:         "success",
+			statuses:     []int{http.StatusOK},
+			wantRequests: 1,
+		},
+		{
+			name:         "throttled once",
+			statuses:     []int{http.StatusTooManyRequests, http.StatusOK},
+			wantRequests: 2,
+		},
+		{
+			name:         "server errors then success",
+			statuses:     []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK},
+			wantRequests: 3,
+		},
+		{
+			name:         "throttled until the retries are used up",
+			statuses:     []int{http.StatusTooManyRequests},
+			wantErr:      true,
+			wantRequests: maxRetries + 1,
+		},
+		{
+			name:         "client errors are not retried",
+			statuses:     []int{http.StatusNotFound},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newStatusServer(t, tt.statuses, func(h http.Header) {
+				h.Set("Retry-After", "0")
+			})
+			client := newTestAPIClient(server)
+
+			_, err := client.GetUser(context.Background(), "user-1")
+			if tt.wantErr && err == nil {
+				t.Error("GetUser succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("GetUser: %v", err)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestAPIClientRetryPastDeadline(t *testing.T) {
+	server, requests := newStatusServer(t, []int{http.StatusTooManyRequests}, func(h http.Header) {
+		h.Set("Retry-After", "60")
+	})
+	client := newTestAPIClient(server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.GetUser(ctx, "user-1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetUser = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
+
+func TestAPIClientRequestBudget(t *testing.T) {
+	server, requests := newStatusServer(t, []int{http.StatusServiceUnavailable}, func(h http.Header) {
+		h.Set("Retry-After", "0")
+	})
+	client := newTestAPIClient(server)
+
+	// The budget covers retries as well as new requests
+	ctx := WithRequestBudget(context.Background(), 2)
+	_, err := client.GetUser(ctx, "user-1")
+	if !errors.Is(err, ErrRequestBudgetExhausted) {
+		t.Errorf("GetUser = %v, want %v", err, ErrRequestBudgetExhausted)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("requests = %d, want 2", n)
+	}
+
+	_, err = client.GetUser(ctx, "user-1")
+	if !errors.Is(err, ErrRequestBudgetExhausted) {
+		t.Errorf("GetUser after the budget was used up = %v, want %v", err, ErrRequestBudgetExhausted)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("requests = %d, want 2", n)
+	}
+}
+
+func TestAPIClientRateLimitHeadersPauseLimiter(t *testing.T) {
+	server, _ := newStatusServer(t, []int{http.StatusOK}, func(h http.Header) {
+		h.Set("inin-ratelimit-count", "300")
+		h.Set("inin-ratelimit-allowed", "300")
+		h.Set("inin-ratelimit-reset", "60")
+	})
+	client := newTestAPIClient(server)
+
+	if _, err := client.GetUser(context.Background(), "user-1"); err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+
+	// The next request would have to wait for the reset, which is past the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.GetUser(ctx, "user-1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetUser = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -9,6 +9,8 @@ type GenesysUser struct {
 	Groups              []GenesysGroup                        `json:"groups"`
 	Presence            apitypes.PresenceEventBody            `json:"presence"`
 	ConversationSummary apitypes.ConversationSummaryEventBody `json:"conversationSummary"`
+	RoutingStatus       apitypes.RoutingStatus                `json:"routingStatus"`
+	Station             *apitypes.StationEventBody            `json:"station"`
 	Images              []GenesysUserImage                    `json:"images"`
 }
 
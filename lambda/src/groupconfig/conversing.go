@@ -0,0 +1,97 @@
+package groupconfig
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+/**
+ * Conversing rules
+ *
+ * A user who is conversing is exempt from the inactivity TTL. The conversation summary reports, per channel, the
+ * number of active and after-call work (ACW) interactions, separately for contact center (ACD) and enterprise
+ * (internal) interactions. A timeout group's ConversingRules say which of these counters count as conversing on which
+ * channel; channels that are left out never count.
+ */
+
+// Conversation channels of the Genesys conversation summary
+const (
+	ChannelCall             = "call"
+	ChannelCallback         = "callback"
+	ChannelChat             = "chat"
+	ChannelEmail            = "email"
+	ChannelMessage          = "message"
+	ChannelSocialExpression = "socialExpression"
+	ChannelVideo            = "video"
+)
+
+// ConversationChannels lists every conversation channel
+var ConversationChannels = []string{ChannelCall, ChannelCallback, ChannelChat, ChannelEmail, ChannelMessage, ChannelSocialExpression, ChannelVideo}
+
+// Conversation counters of a channel
+const (
+	CounterContactCenterActive = "contactCenter.active"
+	CounterContactCenterACW    = "contactCenter.acw"
+	CounterEnterpriseActive    = "enterprise.active"
+	CounterEnterpriseACW       = "enterprise.acw"
+)
+
+// ConversationCounters lists every conversation counter
+var ConversationCounters = []string{CounterContactCenterActive, CounterContactCenterACW, CounterEnterpriseActive, CounterEnterpriseACW}
+
+// DefaultConversingCounters count as conversing on every channel in groups that don't set ConversingRules
+var DefaultConversingCounters = []string{CounterContactCenterActive, CounterContactCenterACW, CounterEnterpriseActive}
+
+// validateConversingRules checks that the rules only use known channels and counters
+func validateConversingRules(rules map[string][]string) error {
+	for channel, counters := range rules {
+		if !slices.Contains(ConversationChannels, channel) {
+			return fmt.Errorf("conversingRules: channel must be one of %s, got %s", strings.Join(ConversationChannels, ", "), channel)
+		}
+		for _, counter := range counters {
+			if !slices.Contains(ConversationCounters, counter) {
+				return fmt.Errorf("conversingRules %s: counter must be one of %s, got %s", channel, strings.Join(ConversationCounters, ", "), counter)
+			}
+		}
+	}
+	return nil
+}
+
+// ConversingCounters returns the counters that count as conversing on the channel in the group
+func (g TimeoutGroup) ConversingCounters(channel string) []string {
+	if g.ConversingRules == nil {
+		return DefaultConversingCounters
+	}
+	return g.ConversingRules[channel]
+}
+
+// IsACWCounter checks if the counter counts after-call work rather than active interactions
+func IsACWCounter(counter string) bool {
+	return counter == CounterContactCenterACW || counter == CounterEnterpriseACW
+}
+
+// ACWPolicy limits how long a user can stay conversing only through after-call work (ACW), which would otherwise keep
+// them exempt from the inactivity TTL indefinitely
+type ACWPolicy struct {
+	MaxMinutes int64 `json:"maxMinutes"`
+	// Action is the enforcement action taken once the user has been in ACW only for MaxMinutes (defaults to
+	// ActionNotify)
+	Action string `json:"action,omitempty"`
+}
+
+// Validate checks that the ACW policy is usable
+func (p ACWPolicy) Validate() error {
+	if p.MaxMinutes <= 0 {
+		return fmt.Errorf("maxMinutes must be greater than 0, got %d", p.MaxMinutes)
+	}
+	return validateAction(p.Action)
+}
+
+// EnforcementAction returns the action taken when the ACW policy is due
+func (p ACWPolicy) EnforcementAction() string {
+	if p.Action == "" {
+		return ActionNotify
+	}
+	return p.Action
+}
@@ -0,0 +1,56 @@
+package groupconfig
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestConversingCounters(t *testing.T) {
+	group := TimeoutGroup{
+		Name:           "Timeout Group - test",
+		TimeoutMinutes: 15,
+		ConversingRules: map[string][]string{
+			ChannelCall: {CounterContactCenterActive, CounterEnterpriseActive},
+		},
+	}
+
+	if got := group.ConversingCounters(ChannelCall); !slices.Equal(got, []string{CounterContactCenterActive, CounterEnterpriseActive}) {
+		t.Errorf("call counters = %v", got)
+	}
+	if got := group.ConversingCounters(ChannelEmail); len(got) != 0 {
+		t.Errorf("email counters = %v, want none for a channel left out of the rules", got)
+	}
+
+	group.ConversingRules = nil
+	for _, channel := range ConversationChannels {
+		if got := group.ConversingCounters(channel); !slices.Equal(got, DefaultConversingCounters) {
+			t.Errorf("%s counters without rules = %v, want %v", channel, got, DefaultConversingCounters)
+		}
+	}
+}
+
+func TestValidateConversingRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   map[string][]string
+		wantErr bool
+	}{
+		{name: "no rules"},
+		{name: "empty channel", rules: map[string][]string{ChannelCall: {}}},
+		{name: "valid", rules: map[string][]string{ChannelCall: {CounterContactCenterActive}, ChannelEmail: {CounterEnterpriseACW}}},
+		{name: "unknown channel", rules: map[string][]string{"fax": {CounterContactCenterActive}}, wantErr: true},
+		{name: "unknown counter", rules: map[string][]string{ChannelCall: {"contactCenter.held"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConversingRules(tt.rules)
+			if tt.wantErr && err == nil {
+				t.Error("validateConversingRules succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("validateConversingRules: %v", err)
+			}
+		})
+	}
+}
@@ -1,12 +1,79 @@
 package groupconfig
 
-import "strings"
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
 
 type TimeoutGroup struct {
-	Name           string
-	TimeoutMinutes int64
+	Name           string `json:"name"`
+	TimeoutMinutes int64  `json:"timeoutMinutes"`
+	// WarningMinutes is the grace period between the pre-logout warning and the logout (0 disables the warning)
+	WarningMinutes int64 `json:"warningMinutes,omitempty"`
+	// DryRun records the users that would be logged out without logging them out
+	DryRun bool `json:"dryRun,omitempty"`
+	// Action is the enforcement action taken when the inactivity TTL expires (defaults to ActionLogout)
+	Action string `json:"action,omitempty"`
+	// Steps is an escalation ladder that replaces TimeoutMinutes and Action (TimeoutMinutes may be omitted)
+	Steps []Step `json:"steps,omitempty"`
+	// PresenceOverrides maps secondary presence definition IDs (e.g. Meeting or Training) to their own timeout
+	PresenceOverrides map[string]PresenceOverride `json:"presenceOverrides,omitempty"`
+	// ExemptPresences are the system presences exempt from the TTL (DefaultExemptPresences if not set, an empty list
+	// exempts none)
+	ExemptPresences []string `json:"exemptPresences"`
+	// Schedule limits enforcement to business hours (see schedule.go)
+	Schedule *Schedule `json:"schedule,omitempty"`
+	// ConversingRules maps channels to the counters that count as conversing on them (see conversing.go)
+	ConversingRules map[string][]string `json:"conversingRules,omitempty"`
+	// ACWPolicy limits how long after-call work alone keeps a user exempt (see conversing.go)
+	ACWPolicy *ACWPolicy `json:"acwPolicy,omitempty"`
+	// MaxSessionMinutes logs users out once their session (since they came online) is this long, active or not. The
+	// logout is deferred while the user is conversing. 0 disables the cap.
+	MaxSessionMinutes int64 `json:"maxSessionMinutes,omitempty"`
+	// NotRespondingMinutes is how long a user can be On Queue but Not Responding before the first enforcement step, and
+	// NoStationMinutes how long an online user can be without an associated station. These conditions count as
+	// inactivity even in exempt presences (but not while conversing). 0 disables the condition.
+	NotRespondingMinutes int64 `json:"notRespondingMinutes,omitempty"`
+	NoStationMinutes     int64 `json:"noStationMinutes,omitempty"`
 }
 
+// DefaultExemptPresences are exempt from the TTL in groups that don't set ExemptPresences (i.e. offline or ACD)
+var DefaultExemptPresences = []string{"offline", "idle", "on_queue"}
+
+// PresenceOverride replaces the group's inactivity timeout while the user has a secondary presence, or exempts them
+type PresenceOverride struct {
+	// Name of the presence (non-functional, for display purposes only)
+	Name           string `json:"name,omitempty"`
+	TimeoutMinutes int64  `json:"timeoutMinutes,omitempty"`
+	Exempt         bool   `json:"exempt,omitempty"`
+}
+
+// Step is a rung of an escalation ladder: the enforcement action taken once the user has been inactive for
+// AfterMinutes
+type Step struct {
+	AfterMinutes int64  `json:"afterMinutes"`
+	Action       string `json:"action"`
+}
+
+// Enforcement actions
+const (
+	// ActionLogout revokes all of the user's tokens, logging them out of every session
+	ActionLogout = "logout"
+	// ActionPresenceOffline sets the user's presence to Offline
+	ActionPresenceOffline = "presence_offline"
+	// ActionPresenceAway sets the user's presence to Away
+	ActionPresenceAway = "presence_away"
+	// ActionOffQueue sets the user's routing status to OFF_QUEUE
+	ActionOffQueue = "off_queue"
+	// ActionNotify only notifies the user
+	ActionNotify = "notify"
+)
+
+// EnforcementActions lists every enforcement action
+var EnforcementActions = []string{ActionLogout, ActionPresenceOffline, ActionPresenceAway, ActionOffQueue, ActionNotify}
+
 /**
  * Timeout Groups
  *
@@ -14,9 +81,14 @@ type TimeoutGroup struct {
  *
  * The key is the Genesys group ID.
  *
- * The value is the name of the group (non-functional, for display purposes only) and the timeout in minutes.
+ * The value is the name of the group (non-functional, for display purposes only), the timeout in minutes, and
+ * optionally the number of minutes before the timeout that the user is warned, whether the group is in dry-run mode
+ * and the enforcement action (logout by default). Instead of a single timeout and action, a group can define an
+ * escalation ladder of steps, each with its own inactivity time and action, and can limit enforcement to business
+ * hours.
  *
- * These should be updated to reflect the group configuration for your org.
+ * These are the compiled-in defaults. They are used when no timeout group config document has been stored in
+ * DynamoDB (see source.go), or when the stored document cannot be loaded or fails validation.
  */
 
 var TimeoutGroups = map[string]TimeoutGroup{
@@ -30,8 +102,172 @@ var TimeoutGroups = map[string]TimeoutGroup{
 	},
 }
 
-// IsPresenceTTLExempt checks if the presence is exempt from the TTL (i.e. offline or ACD)
-func IsPresenceTTLExempt(systemPresence string) bool {
-	p := strings.ToLower(systemPresence)
-	return p == "offline" || p == "idle" || p == "on_queue"
+// Validate checks that the timeout group is usable
+func (g TimeoutGroup) Validate() error {
+	if strings.TrimSpace(g.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(g.Steps) == 0 {
+		if g.TimeoutMinutes <= 0 {
+			return fmt.Errorf("timeoutMinutes must be greater than 0, got %d", g.TimeoutMinutes)
+		}
+		if err := validateAction(g.Action); err != nil {
+			return err
+		}
+	} else {
+		if g.Action != "" {
+			return fmt.Errorf("action can't be combined with steps, set the action of each step instead")
+		}
+		if g.TimeoutMinutes != 0 && g.TimeoutMinutes != g.Steps[0].AfterMinutes {
+			return fmt.Errorf("timeoutMinutes must match the first step, got %d", g.TimeoutMinutes)
+		}
+		var previous int64
+		for i, step := range g.Steps {
+			if step.AfterMinutes <= previous {
+				return fmt.Errorf("step %d: afterMinutes must be greater than 0 and than the previous step, got %d", i+1, step.AfterMinutes)
+			}
+			if step.Action == "" {
+				return fmt.Errorf("step %d: action is required", i+1)
+			}
+			if err := validateAction(step.Action); err != nil {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+			previous = step.AfterMinutes
+		}
+	}
+	if g.WarningMinutes < 0 || g.WarningMinutes >= g.InactivityMinutes() {
+		return fmt.Errorf("warningMinutes must be between 0 and the inactivity timeout, got %d", g.WarningMinutes)
+	}
+	if g.Schedule != nil {
+		if err := g.Schedule.Validate(); err != nil {
+			return fmt.Errorf("invalid schedule: %w", err)
+		}
+	}
+	for _, presence := range g.ExemptPresences {
+		if strings.TrimSpace(presence) == "" {
+			return fmt.Errorf("exemptPresences can't contain an empty presence")
+		}
+	}
+	if g.NotRespondingMinutes < 0 || (g.NotRespondingMinutes > 0 && g.NotRespondingMinutes <= g.WarningMinutes) {
+		return fmt.Errorf("notRespondingMinutes must be 0 or greater than warningMinutes, got %d", g.NotRespondingMinutes)
+	}
+	if g.NoStationMinutes < 0 || (g.NoStationMinutes > 0 && g.NoStationMinutes <= g.WarningMinutes) {
+		return fmt.Errorf("noStationMinutes must be 0 or greater than warningMinutes, got %d", g.NoStationMinutes)
+	}
+	if g.MaxSessionMinutes < 0 {
+		return fmt.Errorf("maxSessionMinutes must not be negative, got %d", g.MaxSessionMinutes)
+	}
+	if err := validateConversingRules(g.ConversingRules); err != nil {
+		return err
+	}
+	if g.ACWPolicy != nil {
+		if err := g.ACWPolicy.Validate(); err != nil {
+			return fmt.Errorf("invalid acwPolicy: %w", err)
+		}
+	}
+	for presenceID, override := range g.PresenceOverrides {
+		if override.Exempt == (override.TimeoutMinutes != 0) {
+			return fmt.Errorf("presence override %s: either timeoutMinutes or exempt must be set", presenceID)
+		}
+		if !override.Exempt && override.TimeoutMinutes <= g.WarningMinutes {
+			return fmt.Errorf("presence override %s: timeoutMinutes must be greater than warningMinutes, got %d", presenceID, override.TimeoutMinutes)
+		}
+	}
+	return nil
+}
+
+func validateAction(action string) error {
+	if action != "" && !slices.Contains(EnforcementActions, action) {
+		return fmt.Errorf("action must be one of %s, got %s", strings.Join(EnforcementActions, ", "), action)
+	}
+	return nil
+}
+
+// Ladder returns the escalation steps of the group. Groups without steps have a single step at TimeoutMinutes.
+func (g TimeoutGroup) Ladder() []Step {
+	if len(g.Steps) > 0 {
+		return g.Steps
+	}
+	return []Step{{AfterMinutes: g.TimeoutMinutes, Action: g.EnforcementAction()}}
+}
+
+// InactivityMinutes returns how long a user can be inactive before the first enforcement step
+func (g TimeoutGroup) InactivityMinutes() int64 {
+	return g.Ladder()[0].AfterMinutes
+}
+
+// InactivityMinutesFor returns how long a user with the secondary presence can be inactive before the first enforcement
+// step, or exempt if the presence is exempt. Later ladder steps keep their distance from the first step.
+func (g TimeoutGroup) InactivityMinutesFor(secondaryPresenceID string) (minutes int64, exempt bool) {
+	if override, ok := g.PresenceOverrides[secondaryPresenceID]; ok {
+		if override.Exempt {
+			return 0, true
+		}
+		return override.TimeoutMinutes, false
+	}
+	return g.InactivityMinutes(), false
+}
+
+// EffectiveTimeout returns how long a user with the secondary presence can be inactive at the time, or exempt if they
+// are exempt. boundary is the next time the schedule changes (zero if the group has no schedule), after which the
+// result can differ.
+func (g TimeoutGroup) EffectiveTimeout(secondaryPresenceID string, now time.Time) (minutes int64, exempt bool, boundary time.Time) {
+	minutes, exempt = g.InactivityMinutesFor(secondaryPresenceID)
+	if g.Schedule == nil || exempt {
+		return minutes, exempt, time.Time{}
+	}
+
+	boundary = g.Schedule.NextBoundary(now)
+	if !g.Schedule.InHours(now) {
+		if g.Schedule.OutsideHoursTimeoutMinutes == 0 {
+			return 0, true, boundary
+		}
+		minutes = g.Schedule.OutsideHoursTimeoutMinutes
+	}
+	return minutes, false, boundary
+}
+
+// EnforcementAction returns the action taken when the inactivity TTL of a user in the group expires
+func (g TimeoutGroup) EnforcementAction() string {
+	if g.Action == "" {
+		return ActionLogout
+	}
+	return g.Action
+}
+
+// ValidateTimeoutGroups checks every timeout group in the map
+func ValidateTimeoutGroups(groups map[string]TimeoutGroup) error {
+	if len(groups) == 0 {
+		return fmt.Errorf("at least one timeout group is required")
+	}
+	for groupID, group := range groups {
+		if strings.TrimSpace(groupID) == "" {
+			return fmt.Errorf("timeout group ID is required")
+		}
+		if err := group.Validate(); err != nil {
+			return fmt.Errorf("invalid timeout group %s: %w", groupID, err)
+		}
+	}
+	return nil
+}
+
+// IsPresenceTTLExempt checks if the system presence is exempt from the TTL in the group
+func (g TimeoutGroup) IsPresenceTTLExempt(systemPresence string) bool {
+	exemptPresences := g.ExemptPresences
+	if exemptPresences == nil {
+		exemptPresences = DefaultExemptPresences
+	}
+
+	p := normalizePresence(systemPresence)
+	for _, exemptPresence := range exemptPresences {
+		if normalizePresence(exemptPresence) == p {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePresence matches the event form of a system presence (ON_QUEUE) with the API form (On Queue)
+func normalizePresence(systemPresence string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(systemPresence)), " ", "_")
 }
@@ -0,0 +1,218 @@
+package groupconfig
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// The lambda runtime has no zoneinfo database
+	_ "time/tzdata"
+)
+
+/**
+ * Business-hours schedules
+ *
+ * A timeout group with a schedule only enforces its timeout during working hours in the schedule's IANA timezone.
+ * Outside working hours (and on holidays) users are exempt, or get OutsideHoursTimeoutMinutes instead. Inactivity TTLs
+ * are capped at the next schedule boundary, where the reaper re-evaluates them with the timeout that applies from then
+ * on.
+ */
+
+// Schedule is a weekly business-hours schedule
+type Schedule struct {
+	// Timezone is an IANA timezone name, e.g. America/New_York
+	Timezone string         `json:"timezone"`
+	Hours    []WorkingHours `json:"hours"`
+	// Holidays are dates (YYYY-MM-DD) in the timezone that are treated as outside working hours
+	Holidays []string `json:"holidays,omitempty"`
+	// OutsideHoursTimeoutMinutes is the timeout outside working hours (0 exempts users outside working hours)
+	OutsideHoursTimeoutMinutes int64 `json:"outsideHoursTimeoutMinutes,omitempty"`
+}
+
+// WorkingHours are the working hours on a set of weekdays
+type WorkingHours struct {
+	// Days are lowercase weekday abbreviations: mon, tue, wed, thu, fri, sat, sun
+	Days []string `json:"days"`
+	// Start and End are the local times (HH:MM, End can be 24:00) that working hours start and end
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// maxBoundaryDays is how far ahead the next boundary is searched; without one, the TTL is re-evaluated after that
+const maxBoundaryDays = 31
+
+var locationCache = struct {
+	sync.Mutex
+	locations map[string]*time.Location
+}{locations: make(map[string]*time.Location)}
+
+// Validate checks that the schedule is usable
+func (s Schedule) Validate() error {
+	if _, err := loadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", s.Timezone, err)
+	}
+	for i, hours := range s.Hours {
+		if len(hours.Days) == 0 {
+			return fmt.Errorf("hours %d: at least one day is required", i+1)
+		}
+		for _, day := range hours.Days {
+			if _, ok := weekdays[day]; !ok {
+				return fmt.Errorf("hours %d: invalid day %q", i+1, day)
+			}
+		}
+		start, err := parseClock(hours.Start)
+		if err != nil {
+			return fmt.Errorf("hours %d: invalid start: %w", i+1, err)
+		}
+		end, err := parseClock(hours.End)
+		if err != nil {
+			return fmt.Errorf("hours %d: invalid end: %w", i+1, err)
+		}
+		if start >= end {
+			return fmt.Errorf("hours %d: start must be before end", i+1)
+		}
+	}
+	for _, holiday := range s.Holidays {
+		if _, err := time.Parse(time.DateOnly, holiday); err != nil {
+			return fmt.Errorf("invalid holiday %q: %w", holiday, err)
+		}
+	}
+	if s.OutsideHoursTimeoutMinutes < 0 {
+		return fmt.Errorf("outsideHoursTimeoutMinutes must not be negative, got %d", s.OutsideHoursTimeoutMinutes)
+	}
+	return nil
+}
+
+// InHours checks if the time is within working hours
+func (s Schedule) InHours(t time.Time) bool {
+	local := t.In(s.location())
+	if s.isHoliday(local) {
+		return false
+	}
+
+	minute := local.Hour()*60 + local.Minute()
+	for _, hours := range s.Hours {
+		start, _ := parseClock(hours.Start)
+		end, _ := parseClock(hours.End)
+		if hours.hasDay(local.Weekday()) && minute >= start && minute < end {
+			return true
+		}
+	}
+	return false
+}
+
+// NextBoundary returns the next time after t that working hours start or end. If there is none within
+// maxBoundaryDays, the end of that period is returned so the timeout is still re-evaluated.
+func (s Schedule) NextBoundary(t time.Time) time.Time {
+	loc := s.location()
+	local := t.In(loc)
+	inHours := s.InHours(t)
+
+	for d := 0; d <= maxBoundaryDays; d++ {
+		date := time.Date(local.Year(), local.Month(), local.Day()+d, 0, 0, 0, 0, loc)
+
+		// Midnight is a candidate for holidays starting or ending
+		candidates := []time.Time{date}
+		for _, hours := range s.Hours {
+			if !hours.hasDay(date.Weekday()) {
+				continue
+			}
+			start, _ := parseClock(hours.Start)
+			end, _ := parseClock(hours.End)
+			candidates = append(candidates,
+				time.Date(date.Year(), date.Month(), date.Day(), start/60, start%60, 0, 0, loc),
+				time.Date(date.Year(), date.Month(), date.Day(), end/60, end%60, 0, 0, loc),
+			)
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+
+		for _, candidate := range candidates {
+			if candidate.After(t) && s.InHours(candidate) != inHours {
+				return candidate
+			}
+		}
+	}
+
+	return time.Date(local.Year(), local.Month(), local.Day()+maxBoundaryDays+1, 0, 0, 0, 0, loc)
+}
+
+func (s Schedule) isHoliday(local time.Time) bool {
+	date := local.Format(time.DateOnly)
+	for _, holiday := range s.Holidays {
+		if holiday == date {
+			return true
+		}
+	}
+	return false
+}
+
+// location returns the schedule's timezone, or UTC if it is invalid (schedules are validated when they are loaded)
+func (s Schedule) location() *time.Location {
+	loc, err := loadLocation(s.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (h WorkingHours) hasDay(weekday time.Weekday) bool {
+	for _, day := range h.Days {
+		if weekdays[day] == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// loadLocation loads the IANA timezone, caching it for later calls
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, fmt.Errorf("timezone is required")
+	}
+
+	locationCache.Lock()
+	defer locationCache.Unlock()
+
+	if loc, ok := locationCache.locations[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locationCache.locations[name] = loc
+	return loc, nil
+}
+
+// parseClock parses a HH:MM local time into minutes since midnight
+func parseClock(clock string) (int, error) {
+	hourText, minuteText, ok := strings.Cut(clock, ":")
+	if !ok {
+		return 0, fmt.Errorf("expected HH:MM, got %q", clock)
+	}
+	hour, err := strconv.Atoi(hourText)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", clock)
+	}
+	minute, err := strconv.Atoi(minuteText)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", clock)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("%q is not a time of day", clock)
+	}
+	return hour*60 + minute, nil
+}
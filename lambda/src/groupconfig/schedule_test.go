@@ -0,0 +1,308 @@
+package groupconfig
+
+import (
+	"testing"
+	"time"
+)
+
+// localTime parses a "YYYY-MM-DD HH:MM" time in the timezone
+func localTime(t *testing.T, timezone string, value string) time.Time {
+	t.Helper()
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q): %v", timezone, err)
+	}
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+	if err != nil {
+		t.Fatalf("ParseInLocation(%q): %v", value, err)
+	}
+	return parsed
+}
+
+var weekdayHours = []WorkingHours{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:00"}}
+
+// overnightHours are working hours from 22:00 to 06:00, split at midnight
+var overnightHours = []WorkingHours{
+	{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "22:00", End: "24:00"},
+	{Days: []string{"tue", "wed", "thu", "fri", "sat"}, Start: "00:00", End: "06:00"},
+}
+
+func TestInHours(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		at       string
+		want     bool
+	}{
+		{
+			name:     "during working hours",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours},
+			at:       "2026-10-16 09:00",
+			want:     true,
+		},
+		{
+			name:     "end is exclusive",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours},
+			at:       "2026-10-16 17:00",
+		},
+		{
+			name:     "weekend",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours},
+			at:       "2026-10-17 12:00",
+		},
+		{
+			name:     "holiday",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours, Holidays: []string{"2026-10-19"}},
+			at:       "2026-10-19 12:00",
+		},
+		{
+			name:     "day after a holiday",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours, Holidays: []string{"2026-10-19"}},
+			at:       "2026-10-20 12:00",
+			want:     true,
+		},
+		{
+			name:     "overnight before midnight",
+			schedule: Schedule{Timezone: "Europe/London", Hours: overnightHours},
+			at:       "2026-10-19 23:30",
+			want:     true,
+		},
+		{
+			name:     "overnight after midnight",
+			schedule: Schedule{Timezone: "Europe/London", Hours: overnightHours},
+			at:       "2026-10-20 05:59",
+			want:     true,
+		},
+		{
+			name:     "overnight after the end",
+			schedule: Schedule{Timezone: "Europe/London", Hours: overnightHours},
+			at:       "2026-10-20 06:00",
+		},
+		{
+			name:     "after the spring forward",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours},
+			at:       "2026-03-09 09:00",
+			want:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := localTime(t, tt.schedule.Timezone, tt.at)
+			if got := tt.schedule.InHours(at); got != tt.want {
+				t.Errorf("InHours(%v) = %v, want %v", at, got, tt.want)
+			}
+			// The result doesn't depend on the timezone of the time
+			if got := tt.schedule.InHours(at.UTC()); got != tt.want {
+				t.Errorf("InHours(%v) = %v, want %v", at.UTC(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInHoursAcrossDST(t *testing.T) {
+	schedule := Schedule{Timezone: "America/New_York", Hours: weekdayHours}
+
+	// 09:00 is 14:00 UTC before the spring forward on 2026-03-08 and 13:00 UTC after it
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{at: time.Date(2026, 3, 6, 13, 30, 0, 0, time.UTC), want: false},
+		{at: time.Date(2026, 3, 6, 14, 0, 0, 0, time.UTC), want: true},
+		{at: time.Date(2026, 3, 9, 12, 30, 0, 0, time.UTC), want: false},
+		{at: time.Date(2026, 3, 9, 13, 0, 0, 0, time.UTC), want: true},
+	}
+
+	for _, tt := range tests {
+		if got := schedule.InHours(tt.at); got != tt.want {
+			t.Errorf("InHours(%v) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestNextBoundary(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		at       string
+		want     time.Time
+	}{
+		{
+			name:     "end of working hours",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours},
+			at:       "2026-10-16 10:00",
+			want:     time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "start after the weekend",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours},
+			at:       "2026-10-16 17:00",
+			want:     time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "start after a holiday",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours, Holidays: []string{"2026-10-19"}},
+			at:       "2026-10-16 17:00",
+			want:     time.Date(2026, 10, 20, 13, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "holiday starting at midnight",
+			schedule: Schedule{
+				Timezone: "America/New_York",
+				Hours:    []WorkingHours{{Days: []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}, Start: "00:00", End: "24:00"}},
+				Holidays: []string{"2026-10-21"},
+			},
+			at:   "2026-10-20 12:00",
+			want: time.Date(2026, 10, 21, 4, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "holiday ending at midnight",
+			schedule: Schedule{
+				Timezone: "America/New_York",
+				Hours:    []WorkingHours{{Days: []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}, Start: "00:00", End: "24:00"}},
+				Holidays: []string{"2026-10-21"},
+			},
+			at:   "2026-10-21 12:00",
+			want: time.Date(2026, 10, 22, 4, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "overnight hours continue past midnight",
+			schedule: Schedule{Timezone: "Europe/London", Hours: overnightHours},
+			at:       "2026-10-19 23:00",
+			want:     time.Date(2026, 10, 20, 5, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "overnight hours start",
+			schedule: Schedule{Timezone: "Europe/London", Hours: overnightHours},
+			at:       "2026-10-20 12:00",
+			want:     time.Date(2026, 10, 20, 21, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "overnight hours end on the last day",
+			schedule: Schedule{Timezone: "Europe/London", Hours: overnightHours},
+			at:       "2026-10-24 01:00",
+			want:     time.Date(2026, 10, 24, 5, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "start after the spring forward",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours},
+			at:       "2026-03-06 17:00",
+			want:     time.Date(2026, 3, 9, 13, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "start after the fall back",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours},
+			at:       "2026-10-30 17:00",
+			want:     time.Date(2026, 11, 2, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "overnight hours across the fall back",
+			schedule: Schedule{
+				Timezone: "Europe/London",
+				Hours: []WorkingHours{
+					{Days: []string{"sat"}, Start: "22:00", End: "24:00"},
+					{Days: []string{"sun"}, Start: "00:00", End: "06:00"},
+				},
+			},
+			// The clocks go back at 02:00 BST on 2026-10-25, so the shift is 9 hours long
+			at:   "2026-10-24 22:00",
+			want: time.Date(2026, 10, 25, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "boundary on the last day searched",
+			schedule: Schedule{
+				Timezone: "America/New_York",
+				Hours:    []WorkingHours{{Days: []string{"mon"}, Start: "09:00", End: "17:00"}},
+				Holidays: []string{"2026-10-19", "2026-10-26", "2026-11-02", "2026-11-09"},
+			},
+			// 2026-11-16 is 31 days after 2026-10-16
+			at:   "2026-10-16 12:00",
+			want: time.Date(2026, 11, 16, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "no boundary within the search limit",
+			schedule: Schedule{
+				Timezone: "America/New_York",
+				Hours:    []WorkingHours{{Days: []string{"mon"}, Start: "09:00", End: "17:00"}},
+				Holidays: []string{"2026-10-19", "2026-10-26", "2026-11-02", "2026-11-09", "2026-11-16"},
+			},
+			// The search ends at midnight 32 days later, in EST after the fall back
+			at:   "2026-10-16 12:00",
+			want: time.Date(2026, 11, 17, 5, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "no working hours",
+			schedule: Schedule{Timezone: "America/New_York"},
+			at:       "2026-10-16 12:00",
+			want:     time.Date(2026, 11, 17, 5, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schedule.Validate(); err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			at := localTime(t, tt.schedule.Timezone, tt.at)
+			if got := tt.schedule.NextBoundary(at); !got.Equal(tt.want) {
+				t.Errorf("NextBoundary(%v) = %v, want %v", at, got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		wantErr  bool
+	}{
+		{
+			name:     "valid",
+			schedule: Schedule{Timezone: "America/New_York", Hours: weekdayHours, Holidays: []string{"2026-12-25"}},
+		},
+		{
+			name:     "missing timezone",
+			schedule: Schedule{Hours: weekdayHours},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown timezone",
+			schedule: Schedule{Timezone: "Mars/Olympus_Mons", Hours: weekdayHours},
+			wantErr:  true,
+		},
+		{
+			name:     "overnight hours in one entry",
+			schedule: Schedule{Timezone: "UTC", Hours: []WorkingHours{{Days: []string{"mon"}, Start: "22:00", End: "06:00"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "end after midnight",
+			schedule: Schedule{Timezone: "UTC", Hours: []WorkingHours{{Days: []string{"mon"}, Start: "22:00", End: "24:01"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid day",
+			schedule: Schedule{Timezone: "UTC", Hours: []WorkingHours{{Days: []string{"monday"}, Start: "09:00", End: "17:00"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid holiday",
+			schedule: Schedule{Timezone: "UTC", Hours: weekdayHours, Holidays: []string{"12/25/2026"}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schedule.Validate()
+			if tt.wantErr && err == nil {
+				t.Error("Validate succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Validate: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package groupconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/**
+ * Timeout group config source
+ *
+ * The timeout groups can be stored as a JSON document (YAML is not supported) in the user activity table so they can be changed without
+ * rebuilding and redeploying the lambda functions. The document is stored in the "document" attribute of the item
+ * with _pk and _sk "cfg|timeoutgroups" and has the following format:
+ *
+ * {
+ *   "timeoutGroups": {
+ *     "e613e69c-a2d4-40fc-aba5-a9a5eb43eeef": { "name": "Timeout Group - agents", "timeoutMinutes": 15 }
+ *   }
+ * }
+ *
+ * The document is cached and reloaded after TIMEOUT_GROUPS_REFRESH_SECONDS (default 300). If the document does not
+ * exist, cannot be read, or fails validation, the last good config is kept, or the compiled-in TimeoutGroups are used.
+ */
+
+const (
+	configKey             = "cfg|timeoutgroups"
+	defaultRefreshSeconds = 300
+)
+
+// Source loads the raw timeout group config document
+type Source interface {
+	// Load returns the config document, or nil if no document has been stored
+	Load(ctx context.Context) ([]byte, error)
+}
+
+// Document is the stored timeout group config document
+type Document struct {
+	TimeoutGroups map[string]TimeoutGroup `json:"timeoutGroups"`
+}
+
+// configItem is the DB record holding the config document
+type configItem struct {
+	PartitionKey string `dynamodbav:"_pk"`
+	SortKey      string `dynamodbav:"_sk"`
+	Document     string `dynamodbav:"document"`
+}
+
+// DynamoDBSource loads the config document from the user activity table
+type DynamoDBSource struct {
+	TableName string
+
+	once   sync.Once
+	client *dynamodb.Client
+	err    error
+}
+
+func (s *DynamoDBSource) Load(ctx context.Context) ([]byte, error) {
+	s.once.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			s.err = fmt.Errorf("failed to load AWS config: %w", err)
+			return
+		}
+		s.client = dynamodb.NewFromConfig(cfg)
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &s.TableName,
+		Key: map[string]types.AttributeValue{
+			"_pk": &types.AttributeValueMemberS{Value: configKey},
+			"_sk": &types.AttributeValueMemberS{Value: configKey},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timeout group config from DynamoDB: %w", err)
+	}
+	if result == nil || len(result.Item) == 0 {
+		return nil, nil
+	}
+
+	var item configItem
+	if err := attributevalue.UnmarshalMap(result.Item, &item); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal timeout group config from DynamoDB: %w", err)
+	}
+
+	return []byte(item.Document), nil
+}
+
+// ParseDocument parses and validates a timeout group config document
+func ParseDocument(data []byte) (map[string]TimeoutGroup, error) {
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse timeout group config: %w", err)
+	}
+
+	if err := ValidateTimeoutGroups(doc.TimeoutGroups); err != nil {
+		return nil, err
+	}
+
+	return doc.TimeoutGroups, nil
+}
+
+// Loader caches the timeout groups loaded from a Source
+type Loader struct {
+	source          Source
+	refreshInterval time.Duration
+	defaults        map[string]TimeoutGroup
+
+	mu       sync.Mutex
+	groups   map[string]TimeoutGroup
+	loadedAt time.Time
+	// loading is closed when the load in progress completes (nil if none is)
+	loading chan struct{}
+}
+
+func NewLoader(source Source, refreshInterval time.Duration, defaults map[string]TimeoutGroup) *Loader {
+	return &Loader{
+		source:          source,
+		refreshInterval: refreshInterval,
+		defaults:        defaults,
+	}
+}
+
+// Groups returns the current timeout groups, reloading them from the source if the cache has expired. Only one caller
+// loads at a time and the lock isn't held while loading, so the other callers keep using the cached groups meanwhile
+// (or wait for the first load).
+func (l *Loader) Groups() map[string]TimeoutGroup {
+	l.mu.Lock()
+	if l.groups != nil && (l.loading != nil || time.Since(l.loadedAt) < l.refreshInterval) {
+		groups := l.groups
+		l.mu.Unlock()
+		return groups
+	}
+	if loading := l.loading; loading != nil {
+		l.mu.Unlock()
+		<-loading
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.groups
+	}
+
+	loading := make(chan struct{})
+	l.loading = loading
+	first := l.groups == nil
+	// Try again after the refresh interval, even if the load fails
+	l.loadedAt = time.Now()
+	l.mu.Unlock()
+
+	groups := l.load(first)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if groups != nil {
+		l.groups = groups
+	}
+	// Keep the last good config, or fall back to the defaults
+	if l.groups == nil {
+		l.groups = l.defaults
+	}
+	l.loading = nil
+	close(loading)
+
+	return l.groups
+}
+
+// load loads the timeout groups from the source, or returns nil to keep the last good config
+func (l *Loader) load(first bool) map[string]TimeoutGroup {
+	if l.source == nil {
+		return l.defaults
+	}
+
+	data, err := l.source.Load(context.Background())
+	if err != nil {
+		fmt.Printf("failed to load timeout group config: %v\n", err)
+		return nil
+	}
+	if data == nil {
+		if first {
+			fmt.Println("No timeout group config found, using compiled-in defaults")
+		}
+		return l.defaults
+	}
+	groups, err := ParseDocument(data)
+	if err != nil {
+		fmt.Printf("invalid timeout group config: %v\n", err)
+		return nil
+	}
+	fmt.Printf("Loaded %d timeout groups from config\n", len(groups))
+	return groups
+}
+
+// defaultLoader is read by concurrent lookups and can be replaced by SetTimeoutGroups
+var defaultLoader atomic.Pointer[Loader]
+
+func init() {
+	defaultLoader.Store(NewLoader(defaultSource(), refreshInterval(), TimeoutGroups))
+}
+
+func defaultSource() Source {
+	tableName := os.Getenv("DYNAMODB_TABLE")
+	if tableName == "" {
+		return nil
+	}
+	return &DynamoDBSource{TableName: tableName}
+}
+
+// refreshInterval returns TIMEOUT_GROUPS_REFRESH_SECONDS, or the default if it isn't a positive number (0 would load the
+// document on every lookup, and there are several per record)
+func refreshInterval() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("TIMEOUT_GROUPS_REFRESH_SECONDS"))
+	if err != nil || seconds <= 0 {
+		seconds = defaultRefreshSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// SetTimeoutGroups replaces the configured timeout groups, e.g. in tests; the config document is no longer loaded
+func SetTimeoutGroups(groups map[string]TimeoutGroup) {
+	defaultLoader.Store(NewLoader(nil, defaultRefreshSeconds*time.Second, groups))
+}
+
+// GetTimeoutGroups returns all configured timeout groups
+func GetTimeoutGroups() map[string]TimeoutGroup {
+	return defaultLoader.Load().Groups()
+}
+
+// GetTimeoutGroup returns the configured timeout group for the Genesys group ID
+func GetTimeoutGroup(groupID string) (TimeoutGroup, bool) {
+	group, ok := defaultLoader.Load().Groups()[groupID]
+	return group, ok
+}
@@ -1,69 +1,129 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 	"user-activity-monitor/src/apitypes"
 	"user-activity-monitor/src/db"
+	"user-activity-monitor/src/genesys"
 )
 
-func processPresenceEvent(userID string, event apitypes.PresenceEventBody) error {
-	fmt.Printf("Processing presence event: %v\n", event)
-
-	// Get existing user activity
-	ua, err := db.GetUserActivity(userID)
-	if err != nil {
-		fmt.Printf("failed to get user activity: %v\n", err)
+func processPresenceEvent(ctx context.Context, gc genesys.Client, userID string, eventID string, timestamp time.Time, event apitypes.PresenceEventBody) error {
+	// Prefer the presence modified date over the notification timestamp
+	if !event.ModifiedDate.IsZero() {
+		timestamp = event.ModifiedDate
 	}
-	if ua == nil {
-		fmt.Printf("no user activity found, lazy initializing\n")
-		// Lazy init
-		ua = db.CreateUserActivity(userID)
+
+	comingOnline := func(ua db.UserActivity) bool {
+		return strings.EqualFold(ua.Presence, "OFFLINE") && !strings.EqualFold(event.PresenceDefinition.SystemPresence, "OFFLINE")
 	}
 
-	if strings.EqualFold(ua.Presence, "OFFLINE") && !strings.EqualFold(event.PresenceDefinition.SystemPresence, "OFFLINE") {
-		// Refresh user's config when they come back online
-		ua.RefreshUser()
-	} else {
-		// Set current presence
-		ua.Presence = event.PresenceDefinition.SystemPresence
-		ua.SecondaryPresenceID = event.PresenceDefinition.ID
+	// Fetch the user's config when they come back online. It is fetched once, before the write, so that re-applying
+	// the event after a concurrent update doesn't repeat the API request.
+	var genesysUser *genesys.GenesysUser
+	fetch := func(ua db.UserActivity) {
+		if !comingOnline(ua) {
+			return
+		}
+		var err error
+		genesysUser, err = gc.GetUser(ctx, userID)
+		if err != nil {
+			fmt.Printf("failed to get Genesys user: %v\n", err)
+		}
 	}
 
-	// Check
-	ua.CheckActivity()
+	return applyEvent(ctx, gc, userID, fetch, func(ua *db.UserActivity) bool {
+		if ua.IsStalePresenceEvent(eventID, timestamp) {
+			fmt.Printf("dropping stale or duplicate presence event %s (%v)\n", eventID, timestamp)
+			return false
+		}
 
-	// Write to database
-	if err := db.WriteUserActivity(*ua, false); err != nil {
-		fmt.Printf("failed to write user activity: %v\n", err)
-	}
+		// Start or end the session before the previous presence is replaced
+		ua.UpdateSession(event.PresenceDefinition.SystemPresence, timestamp)
 
-	return nil
+		if comingOnline(*ua) && genesysUser != nil {
+			// Refresh user's config when they come back online
+			ua.ApplyGenesysUser(*genesysUser)
+		} else {
+			// Set current presence (also if the user couldn't be fetched)
+			ua.Presence = event.PresenceDefinition.SystemPresence
+			ua.SecondaryPresenceID = event.PresenceDefinition.ID
+		}
+		ua.SetPresenceEvent(eventID, timestamp)
+		return true
+	}, (*db.UserActivity).CheckActivity)
+}
+
+func processConversationSummaryEvent(ctx context.Context, gc genesys.Client, userID string, eventID string, timestamp time.Time, event apitypes.ConversationSummaryEventBody) error {
+	return applyEvent(ctx, gc, userID, nil, func(ua *db.UserActivity) bool {
+		if ua.IsStaleConversationsEvent(eventID, timestamp) {
+			fmt.Printf("dropping stale or duplicate conversation summary event %s (%v)\n", eventID, timestamp)
+			return false
+		}
+
+		// Set current conversations
+		ua.UpdateConversations(event)
+		ua.SetConversationsEvent(eventID, timestamp)
+		return true
+	}, (*db.UserActivity).CheckActivity)
 }
 
-func processConversationSummaryEvent(userID string, event apitypes.ConversationSummaryEventBody) error {
-	fmt.Printf("Processing conversation summary event: %v\n", event)
+func processRoutingStatusEvent(ctx context.Context, gc genesys.Client, userID string, eventID string, timestamp time.Time, event apitypes.RoutingStatusEventBody) error {
+	return applyEvent(ctx, gc, userID, nil, func(ua *db.UserActivity) bool {
+		if ua.IsStaleRoutingStatusEvent(eventID, timestamp) {
+			fmt.Printf("dropping stale or duplicate routing status event %s (%v)\n", eventID, timestamp)
+			return false
+		}
 
-	// Get existing user activity
-	ua, err := db.GetUserActivity(userID)
+		// Set current routing status
+		ua.UpdateRoutingStatus(event.RoutingStatus)
+		ua.SetRoutingStatusEvent(eventID, timestamp)
+		return true
+	}, (*db.UserActivity).CheckInactivityConditions)
+}
+
+func processStationEvent(ctx context.Context, gc genesys.Client, userID string, eventID string, timestamp time.Time, event apitypes.StationEventBody) error {
+	return applyEvent(ctx, gc, userID, nil, func(ua *db.UserActivity) bool {
+		if ua.IsStaleStationEvent(eventID, timestamp) {
+			fmt.Printf("dropping stale or duplicate station event %s (%v)\n", eventID, timestamp)
+			return false
+		}
+
+		// Set current station
+		ua.UpdateStation(event, timestamp)
+		ua.SetStationEvent(eventID, timestamp)
+		return true
+	}, (*db.UserActivity).CheckInactivityConditions)
+}
+
+// applyEvent reads the user's activity, applies the event, runs the check and writes it back. If the record is updated
+// concurrently, it is re-read and the event is re-applied. prepare (if set) is called once with the record read, before
+// the event is applied, e.g. to fetch data from Genesys. apply returns false if the event should be dropped.
+func applyEvent(ctx context.Context, gc genesys.Client, userID string, prepare func(ua db.UserActivity), apply func(ua *db.UserActivity) bool, check func(ua *db.UserActivity)) error {
+	// Get existing user activity (or a new record if there is none). A failed read is returned so the event is retried,
+	// rather than writing a new record over the stored one.
+	ua, err := db.GetUserActivity(ctx, gc, userID)
 	if err != nil {
-		fmt.Printf("failed to get user activity: %v\n", err)
+		return fmt.Errorf("failed to get user activity: %w", err)
 	}
-	if ua == nil {
-		fmt.Printf("no user activity found, lazy initializing\n")
-		// Lazy init
-		ua = db.CreateUserActivity(userID)
+	if prepare != nil {
+		prepare(*ua)
 	}
 
-	// Set current conversations
-	ua.UpdateConversations(event)
-
-	// Check
-	ua.CheckActivity()
-
 	// Write to database
-	if err := db.WriteUserActivity(*ua, false); err != nil {
-		fmt.Printf("failed to write user activity: %v\n", err)
+	err = db.SaveUserActivityChange(*ua, func(ua *db.UserActivity) bool {
+		if !apply(ua) {
+			return false
+		}
+
+		// Check
+		check(ua)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write user activity: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"user-activity-monitor/src/apitypes"
+	"user-activity-monitor/src/db"
+	"user-activity-monitor/src/genesys"
+	"user-activity-monitor/src/groupconfig"
+)
+
+const (
+	testGroupID = "0f6c1b4e-3d2a-4c8e-9b7f-5a1d2e3f4a5b"
+	testUserID  = "7d3e2c1b-4a5f-4e6d-8c7b-9a0f1e2d3c4b"
+)
+
+// eventMetric is the part of a logged event metric the tests check
+type eventMetric struct {
+	Topic   string `json:"Topic"`
+	Outcome string `json:"Outcome"`
+	Events  int    `json:"Events"`
+}
+
+// captureMetrics records the event metrics logged during the test
+func captureMetrics(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var output bytes.Buffer
+	previousOutput := metricsOutput
+	metricsOutput = &output
+	t.Cleanup(func() {
+		metricsOutput = previousOutput
+	})
+	return &output
+}
+
+// loggedMetrics parses the event metrics logged to output
+func loggedMetrics(t *testing.T, output *bytes.Buffer) []eventMetric {
+	t.Helper()
+
+	var metrics []eventMetric
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var metric eventMetric
+		if err := json.Unmarshal([]byte(line), &metric); err != nil {
+			t.Fatalf("failed to parse metric %q: %v", line, err)
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// presenceEvent creates a presence notification as delivered by EventBridge
+func presenceEvent(detailType string, topicName string, systemPresence string) apitypes.EventBridgeEvent {
+	return apitypes.EventBridgeEvent{
+		ID:         "0c7a2e56-1b3d-4f5e-8a9b-0c1d2e3f4a5b",
+		DetailType: detailType,
+		Detail: apitypes.EventDetail{
+			TopicName: topicName,
+			Timestamp: time.Now(),
+			EventBody: map[string]interface{}{
+				"presenceDefinition": map[string]interface{}{"id": "6a3af858-942f-489d-9700-5f9bcdcdae9b", "systemPresence": systemPresence},
+			},
+		},
+	}
+}
+
+func TestHandleRequestDispatch(t *testing.T) {
+	db.SetStore(db.NewMemoryStore())
+	db.SetScheduler(nil)
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		testGroupID: {Name: "Timeout Group - test", TimeoutMinutes: 15},
+	})
+	gc := genesys.NewFakeClient()
+	gc.Users[testUserID] = &genesys.GenesysUser{ID: testUserID, Name: "Test User", Groups: []genesys.GenesysGroup{{ID: testGroupID}}}
+
+	tests := []struct {
+		name        string
+		event       apitypes.EventBridgeEvent
+		wantOutcome string
+		wantStored  bool
+	}{
+		{
+			name:        "unknown topic",
+			event:       presenceEvent("v2.users.{id}.geolocation", "v2.users."+testUserID+".geolocation", "AVAILABLE"),
+			wantOutcome: outcomeUnknownTopic,
+		},
+		{
+			name:        "topic name without an ID",
+			event:       presenceEvent("v2.users.{id}.presence", "v2.users.me.presence", "AVAILABLE"),
+			wantOutcome: outcomeInvalidTopic,
+		},
+		{
+			name:        "registered topic",
+			event:       presenceEvent("v2.users.{id}.presence", "v2.users."+testUserID+".presence", "AVAILABLE"),
+			wantOutcome: outcomeProcessed,
+			wantStored:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetStore(db.NewMemoryStore())
+			output := captureMetrics(t)
+
+			// Events that can't be handled are dropped rather than retried
+			if err := handleRequest(context.Background(), gc, tt.event); err != nil {
+				t.Fatalf("failed to handle event: %v", err)
+			}
+
+			metrics := loggedMetrics(t, output)
+			if len(metrics) != 1 {
+				t.Fatalf("logged metrics %+v, want 1", metrics)
+			}
+			want := eventMetric{Topic: tt.event.DetailType, Outcome: tt.wantOutcome, Events: 1}
+			if metrics[0] != want {
+				t.Errorf("metric = %+v, want %+v", metrics[0], want)
+			}
+
+			ua, err := db.ReadUserActivity(testUserID)
+			if err != nil {
+				t.Fatalf("failed to read user activity: %v", err)
+			}
+			if (ua != nil) != tt.wantStored {
+				t.Errorf("stored user activity %+v, want stored %v", ua, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestHandleRequestFailedEvent(t *testing.T) {
+	db.SetStore(db.NewMemoryStore())
+	db.SetScheduler(nil)
+	output := captureMetrics(t)
+
+	// The event body of a presence event must be an object
+	event := presenceEvent("v2.users.{id}.presence", "v2.users."+testUserID+".presence", "AVAILABLE")
+	event.Detail.EventBody = map[string]interface{}{"presenceDefinition": "available"}
+	if err := handleRequest(context.Background(), genesys.NewFakeClient(), event); err == nil {
+		t.Fatal("handled an invalid event body, want an error")
+	}
+
+	metrics := loggedMetrics(t, output)
+	want := eventMetric{Topic: "v2.users.{id}.presence", Outcome: outcomeFailed, Events: 1}
+	if len(metrics) != 1 || metrics[0] != want {
+		t.Errorf("metrics = %+v, want %+v", metrics, want)
+	}
+}
+
+func TestRegisteredTopics(t *testing.T) {
+	tests := []struct {
+		topic     string
+		topicName string
+		wantID    string
+	}{
+		{"v2.users.{id}.presence", "v2.users." + testUserID + ".presence", testUserID},
+		{"v2.users.{id}.conversationsummary", "v2.users." + testUserID + ".conversationsummary", testUserID},
+		{"v2.users.{id}.routingStatus", "v2.users." + testUserID + ".routingStatus", testUserID},
+		{"v2.users.{id}.station", "v2.users." + testUserID + ".station", testUserID},
+		// The topic name must match the pattern of the detail type
+		{"v2.users.{id}.presence", "v2.users." + testUserID + ".station", ""},
+		{"v2.users.{id}.presence", "v2.users." + testUserID + ".presence.extra", ""},
+	}
+
+	for _, tt := range tests {
+		handler, ok := eventHandlers[tt.topic]
+		if !ok {
+			t.Errorf("no handler registered for %s", tt.topic)
+			continue
+		}
+		if id := handler.extractID(tt.topicName); id != tt.wantID {
+			t.Errorf("%s handler extracted %q from %s, want %q", tt.topic, id, tt.topicName, tt.wantID)
+		}
+	}
+}
+
+// countingClient counts the users fetched, and calls onGetUser on each fetch
+type countingClient struct {
+	*genesys.FakeClient
+	getUserCalls int
+	onGetUser    func()
+}
+
+func (c *countingClient) GetUser(ctx context.Context, userID string) (*genesys.GenesysUser, error) {
+	c.getUserCalls++
+	if c.onGetUser != nil {
+		c.onGetUser()
+	}
+	return c.FakeClient.GetUser(ctx, userID)
+}
+
+// storeUserActivity writes the record of the test user and reads it back as stored
+func storeUserActivity(t *testing.T, ua db.UserActivity) db.UserActivity {
+	t.Helper()
+
+	if err := db.SaveUserActivity(ua); err != nil {
+		t.Fatalf("failed to store user activity: %v", err)
+	}
+	return readUserActivity(t)
+}
+
+// readUserActivity reads the stored record of the test user
+func readUserActivity(t *testing.T) db.UserActivity {
+	t.Helper()
+
+	ua, err := db.ReadUserActivity(testUserID)
+	if err != nil || ua == nil {
+		t.Fatalf("failed to read user activity: %v (%v)", ua, err)
+	}
+	return *ua
+}
+
+func TestPresenceEventComingOnline(t *testing.T) {
+	db.SetStore(db.NewMemoryStore())
+	db.SetScheduler(nil)
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		testGroupID: {Name: "Timeout Group - test", TimeoutMinutes: 15},
+	})
+
+	// The user was added to the timeout group while offline
+	fake := genesys.NewFakeClient()
+	fake.Users[testUserID] = &genesys.GenesysUser{
+		ID:     testUserID,
+		Name:   "Test User",
+		Groups: []genesys.GenesysGroup{{ID: testGroupID}},
+		Presence: apitypes.PresenceEventBody{
+			PresenceDefinition: apitypes.PresenceDefinition{ID: "6a3af858-942f-489d-9700-5f9bcdcdae9b", SystemPresence: "Available"},
+		},
+	}
+	storeUserActivity(t, db.UserActivity{UserID: testUserID, Presence: "OFFLINE"})
+
+	// Another event is written while the user is fetched, so the presence event is re-applied
+	gc := &countingClient{FakeClient: fake}
+	gc.onGetUser = func() {
+		ua := readUserActivity(t)
+		ua.SetConversationsEvent("concurrent", time.Now())
+		if err := db.SaveUserActivity(ua); err != nil {
+			t.Fatalf("failed to write the concurrent update: %v", err)
+		}
+	}
+
+	event := presenceEvent("v2.users.{id}.presence", "v2.users."+testUserID+".presence", "AVAILABLE")
+	if err := handleRequest(context.Background(), gc, event); err != nil {
+		t.Fatalf("failed to handle event: %v", err)
+	}
+
+	if gc.getUserCalls != 1 {
+		t.Errorf("fetched the user %d times, want once", gc.getUserCalls)
+	}
+	ua := readUserActivity(t)
+	if ua.ConversationsEventID != "concurrent" {
+		t.Error("the concurrent update was overwritten")
+	}
+	if ua.GroupID != testGroupID || ua.InactivityTTL == nil || ua.SessionStartedAt == nil {
+		t.Errorf("group %q, TTL %v, session started at %v, want the fetched group with a TTL and a session",
+			ua.GroupID, ua.InactivityTTL, ua.SessionStartedAt)
+	}
+
+	// Presence changes while online don't fetch the user
+	event = presenceEvent("v2.users.{id}.presence", "v2.users."+testUserID+".presence", "BUSY")
+	event.ID = "5e1b7c3a-9d2f-4a6b-8c0e-1f2a3b4c5d6e"
+	if err := handleRequest(context.Background(), gc, event); err != nil {
+		t.Fatalf("failed to handle event: %v", err)
+	}
+	if gc.getUserCalls != 1 {
+		t.Errorf("fetched the user %d times, want once", gc.getUserCalls)
+	}
+	if ua := readUserActivity(t); ua.Presence != "BUSY" {
+		t.Errorf("presence = %q, want BUSY", ua.Presence)
+	}
+}
+
+func TestPresenceEventStale(t *testing.T) {
+	db.SetStore(db.NewMemoryStore())
+	db.SetScheduler(nil)
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		testGroupID: {Name: "Timeout Group - test", TimeoutMinutes: 15},
+	})
+
+	ua := db.UserActivity{UserID: testUserID, GroupID: testGroupID, Presence: "AVAILABLE"}
+	ua.SetPresenceEvent("5e1b7c3a-9d2f-4a6b-8c0e-1f2a3b4c5d6e", time.Now())
+	stored := storeUserActivity(t, ua)
+
+	// An event older than the applied one, and a redelivery of the applied one
+	older := apitypes.PresenceEventBody{
+		ModifiedDate:       time.Now().Add(-time.Minute),
+		PresenceDefinition: apitypes.PresenceDefinition{SystemPresence: "AWAY"},
+	}
+	if err := processPresenceEvent(context.Background(), genesys.NewFakeClient(), testUserID, "1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d", time.Now(), older); err != nil {
+		t.Fatalf("failed to process event: %v", err)
+	}
+	redelivered := apitypes.PresenceEventBody{PresenceDefinition: apitypes.PresenceDefinition{SystemPresence: "AWAY"}}
+	if err := processPresenceEvent(context.Background(), genesys.NewFakeClient(), testUserID, ua.PresenceEventID, time.Now(), redelivered); err != nil {
+		t.Fatalf("failed to process event: %v", err)
+	}
+
+	if ua := readUserActivity(t); ua.Presence != "AVAILABLE" || ua.Version != stored.Version {
+		t.Errorf("presence %q at version %d, want the stored record unchanged", ua.Presence, ua.Version)
+	}
+}
+
+func TestConversationSummaryEvent(t *testing.T) {
+	db.SetStore(db.NewMemoryStore())
+	db.SetScheduler(nil)
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		testGroupID: {Name: "Timeout Group - test", TimeoutMinutes: 15},
+	})
+
+	ua := db.UserActivity{UserID: testUserID, GroupID: testGroupID, Presence: "AVAILABLE"}
+	ua.CheckActivity()
+	storeUserActivity(t, ua)
+
+	// Conversing exempts the user from the TTL
+	conversing := apitypes.ConversationSummaryEventBody{Call: apitypes.ChannelMetrics{ContactCenter: apitypes.ChannelActivity{Active: 1}}}
+	if err := processConversationSummaryEvent(context.Background(), genesys.NewFakeClient(), testUserID, "1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d", time.Now(), conversing); err != nil {
+		t.Fatalf("failed to process event: %v", err)
+	}
+	if ua := readUserActivity(t); !ua.Conversing || ua.InactivityTTL != nil {
+		t.Errorf("conversing %v with TTL %v, want conversing without a TTL", ua.Conversing, ua.InactivityTTL)
+	}
+
+	// The TTL is armed again once the conversation ends
+	if err := processConversationSummaryEvent(context.Background(), genesys.NewFakeClient(), testUserID, "5e1b7c3a-9d2f-4a6b-8c0e-1f2a3b4c5d6e", time.Now(), apitypes.ConversationSummaryEventBody{}); err != nil {
+		t.Fatalf("failed to process event: %v", err)
+	}
+	if ua := readUserActivity(t); ua.Conversing || ua.InactivityTTL == nil {
+		t.Errorf("conversing %v with TTL %v, want not conversing with a TTL", ua.Conversing, ua.InactivityTTL)
+	}
+}
+
+func TestRoutingStatusEvent(t *testing.T) {
+	db.SetStore(db.NewMemoryStore())
+	db.SetScheduler(nil)
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		testGroupID: {Name: "Timeout Group - test", TimeoutMinutes: 15, NotRespondingMinutes: 5},
+	})
+
+	// On Queue is exempt from the TTL, until the user stops responding
+	ua := db.UserActivity{UserID: testUserID, GroupID: testGroupID, Presence: "ON_QUEUE"}
+	ua.CheckActivity()
+	storeUserActivity(t, ua)
+
+	notResponding := apitypes.RoutingStatusEventBody{RoutingStatus: apitypes.RoutingStatus{Status: "NOT_RESPONDING", StartTime: time.Now()}}
+	if err := processRoutingStatusEvent(context.Background(), genesys.NewFakeClient(), testUserID, "1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d", time.Now(), notResponding); err != nil {
+		t.Fatalf("failed to process event: %v", err)
+	}
+	if ua := readUserActivity(t); ua.Condition != "not responding" || ua.InactivityTTL == nil {
+		t.Errorf("condition %q with TTL %v, want the not responding TTL", ua.Condition, ua.InactivityTTL)
+	}
+
+	idle := apitypes.RoutingStatusEventBody{RoutingStatus: apitypes.RoutingStatus{Status: "IDLE", StartTime: time.Now()}}
+	if err := processRoutingStatusEvent(context.Background(), genesys.NewFakeClient(), testUserID, "5e1b7c3a-9d2f-4a6b-8c0e-1f2a3b4c5d6e", time.Now(), idle); err != nil {
+		t.Fatalf("failed to process event: %v", err)
+	}
+	if ua := readUserActivity(t); ua.Condition != "" || ua.InactivityTTL != nil {
+		t.Errorf("condition %q with TTL %v, want no condition or TTL", ua.Condition, ua.InactivityTTL)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Event outcomes, used as a metric dimension
+const (
+	outcomeProcessed    = "processed"
+	outcomeFailed       = "failed"
+	outcomeUnknownTopic = "unknown_topic"
+	outcomeInvalidTopic = "invalid_topic"
+)
+
+// metricsNamespace is the CloudWatch namespace of the monitor's metrics
+const metricsNamespace = "UserActivityMonitor"
+
+// metricsOutput is where the metrics are logged (replaced in tests)
+var metricsOutput io.Writer = os.Stdout
+
+// recordEventMetric logs the event's outcome and processing time in the CloudWatch embedded metric format, which
+// CloudWatch Logs turns into the Events and ProcessingTime metrics by topic and outcome
+func recordEventMetric(topic string, outcome string, duration time.Duration) {
+	metric := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]interface{}{
+				{
+					"Namespace":  metricsNamespace,
+					"Dimensions": [][]string{{"Topic", "Outcome"}},
+					"Metrics": []map[string]string{
+						{"Name": "Events", "Unit": "Count"},
+						{"Name": "ProcessingTime", "Unit": "Milliseconds"},
+					},
+				},
+			},
+		},
+		"Topic":          topic,
+		"Outcome":        outcome,
+		"Events":         1,
+		"ProcessingTime": duration.Milliseconds(),
+	}
+
+	metricJSON, err := json.Marshal(metric)
+	if err != nil {
+		fmt.Printf("failed to marshal event metric: %v\n", err)
+		return
+	}
+	fmt.Fprintln(metricsOutput, string(metricJSON))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"user-activity-monitor/src/apitypes"
+	"user-activity-monitor/src/genesys"
+)
+
+/**
+ * Event handler registry
+ *
+ * Each Genesys notification topic the monitor consumes is registered with its topic pattern (the EventBridge detail
+ * type, e.g. v2.users.{id}.presence), the struct its event body is parsed into, and the function that processes it.
+ * handleRequest looks the handler up by detail type, extracts the ID from the topic name and calls the handler, so
+ * adding a topic only needs a processing function and a registerHandler call below.
+ */
+
+func init() {
+	registerHandler("v2.users.{id}.presence", "presence", processPresenceEvent)
+	registerHandler("v2.users.{id}.conversationsummary", "conversation summary", processConversationSummaryEvent)
+	registerHandler("v2.users.{id}.routingStatus", "routing status", processRoutingStatusEvent)
+	registerHandler("v2.users.{id}.station", "station", processStationEvent)
+}
+
+// idPattern matches the {id} placeholder of a topic pattern
+const idPattern = `([a-z0-9]{8}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{12})`
+
+// eventHandler processes the events of a topic
+type eventHandler struct {
+	// name describes the events in logs, e.g. presence
+	name string
+	// topicRegex matches the topic names of the topic pattern, capturing the ID
+	topicRegex *regexp.Regexp
+	// handle parses the event body and processes the event
+	handle func(ctx context.Context, gc genesys.Client, id string, event apitypes.EventBridgeEvent) error
+}
+
+// eventHandlers are the registered handlers by topic pattern
+var eventHandlers = make(map[string]eventHandler)
+
+// registerHandler registers the processing function for the topic pattern. The event body is parsed into a B before
+// process is called with the ID from the topic name and the event's ID and timestamp.
+func registerHandler[B any](topic string, name string, process func(ctx context.Context, gc genesys.Client, id string, eventID string, timestamp time.Time, body B) error) {
+	if _, ok := eventHandlers[topic]; ok {
+		panic(fmt.Sprintf("duplicate event handler for topic %s", topic))
+	}
+
+	eventHandlers[topic] = eventHandler{
+		name:       name,
+		topicRegex: topicRegex(topic),
+		handle: func(ctx context.Context, gc genesys.Client, id string, event apitypes.EventBridgeEvent) error {
+			var body B
+			if err := parseEventBody(event.Detail.EventBody, &body); err != nil {
+				return err
+			}
+			fmt.Printf("Processing %s event: %v\n", name, body)
+			return process(ctx, gc, id, event.ID, event.Detail.Timestamp, body)
+		},
+	}
+}
+
+// topicRegex builds the regex matching the topic names of a topic pattern, capturing the {id} placeholder
+func topicRegex(topic string) *regexp.Regexp {
+	pattern := strings.Replace(regexp.QuoteMeta(topic), regexp.QuoteMeta("{id}"), idPattern, 1)
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+// extractID extracts the ID from the topic name, or returns an empty string if the topic name doesn't match
+func (h eventHandler) extractID(topicName string) string {
+	matches := h.topicRegex.FindStringSubmatch(topicName)
+	if len(matches) > 1 {
+		return matches[1]
+	}
+	return ""
+}
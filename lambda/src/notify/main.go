@@ -0,0 +1,98 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Notifier delivers pre-logout warnings, inactivity notices and ACW notices to users
+type Notifier interface {
+	Warn(ctx context.Context, warning Warning) error
+	NotifyInactive(ctx context.Context, inactivity Inactivity) error
+	NotifyStuckInACW(ctx context.Context, acw StuckInACW) error
+}
+
+// FromEnv returns a webhook notifier if WARNING_WEBHOOK_URL is set, otherwise a notifier that only logs the notification
+func FromEnv() Notifier {
+	if webhookURL := os.Getenv("WARNING_WEBHOOK_URL"); webhookURL != "" {
+		return &WebhookNotifier{
+			URL: webhookURL,
+			Client: &http.Client{
+				Timeout: 10 * time.Second,
+			},
+		}
+	}
+	return LogNotifier{}
+}
+
+// LogNotifier writes notifications to the log only
+type LogNotifier struct{}
+
+func (LogNotifier) Warn(ctx context.Context, warning Warning) error {
+	fmt.Printf("Warning user %s: logout at %d unless activity is detected\n", warning.UserID, warning.InactivityTTL)
+	return nil
+}
+
+func (LogNotifier) NotifyInactive(ctx context.Context, inactivity Inactivity) error {
+	fmt.Printf("Notifying user %s: inactive since %d\n", inactivity.UserID, inactivity.InactivityTTL)
+	return nil
+}
+
+func (LogNotifier) NotifyStuckInACW(ctx context.Context, acw StuckInACW) error {
+	fmt.Printf("Notifying user %s: in after-call work since %d\n", acw.UserID, acw.ACWSince)
+	return nil
+}
+
+// WebhookNotifier POSTs notifications as JSON to a webhook, which is responsible for delivering them to the user
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Warn(ctx context.Context, warning Warning) error {
+	warning.Type = TypeWarning
+	return n.post(ctx, warning)
+}
+
+func (n *WebhookNotifier) NotifyInactive(ctx context.Context, inactivity Inactivity) error {
+	inactivity.Type = TypeInactive
+	return n.post(ctx, inactivity)
+}
+
+func (n *WebhookNotifier) NotifyStuckInACW(ctx context.Context, acw StuckInACW) error {
+	acw.Type = TypeACW
+	return n.post(ctx, acw)
+}
+
+// post sends the notification to the webhook as JSON
+func (n *WebhookNotifier) post(ctx context.Context, notification interface{}) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("webhook request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package notify
+
+// Notification types, sent in the type field so the webhook can tell them apart
+const (
+	TypeWarning  = "warning"
+	TypeInactive = "inactive"
+	TypeACW      = "acw"
+)
+
+// Warning is sent to a user before they are logged out for inactivity
+type Warning struct {
+	Type          string `json:"type"`
+	UserID        string `json:"userId"`
+	GroupID       string `json:"groupId"`
+	InactivityTTL int64  `json:"inactivityTTL"`
+	GraceMinutes  int64  `json:"graceMinutes"`
+}
+
+// Inactivity is sent to a user whose inactivity TTL expired, when their timeout group only notifies them
+type Inactivity struct {
+	Type          string `json:"type"`
+	UserID        string `json:"userId"`
+	GroupID       string `json:"groupId"`
+	InactivityTTL int64  `json:"inactivityTTL"`
+}
+
+// StuckInACW is sent to a user who has been in after-call work only for longer than their timeout group's ACW policy
+// allows, when the policy only notifies them
+type StuckInACW struct {
+	Type       string `json:"type"`
+	UserID     string `json:"userId"`
+	GroupID    string `json:"groupId"`
+	ACWSince   int64  `json:"acwSince"`
+	MaxMinutes int64  `json:"maxMinutes"`
+}
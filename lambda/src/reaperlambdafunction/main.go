@@ -1,58 +1,822 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"user-activity-monitor/src/db"
 	"user-activity-monitor/src/genesys"
+	"user-activity-monitor/src/groupconfig"
+	"user-activity-monitor/src/notify"
+	"user-activity-monitor/src/scheduler"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+var notifier = notify.FromEnv()
+
+// dryRun disables logouts for the whole deployment; timeout groups can also be put in dry-run mode individually
+var dryRun = strings.EqualFold(os.Getenv("REAPER_DRY_RUN"), "true")
+
+// Failed logouts are retried with exponential backoff until maxLogoutAttempts is reached
+var maxLogoutAttempts = envInt("REAPER_MAX_LOGOUT_ATTEMPTS", 5)
+var logoutRetryDelay = time.Duration(envInt("REAPER_LOGOUT_RETRY_SECONDS", 300)) * time.Second
+
+const maxLogoutRetryDelay = 2 * time.Hour
+
+// Users are reaped by a pool of workers, which stop taking new users when the lambda deadline is less than
+// deadlineMargin away (enough for a logout request and its DB writes to finish)
+var workers = envInt("REAPER_WORKERS", 5)
+var deadlineMargin = time.Duration(envInt("REAPER_DEADLINE_MARGIN_SECONDS", 20)) * time.Second
+
+// verifyBatchSize is the most users a worker claims and verifies with a single Genesys request
+const verifyBatchSize = 25
+
+// Session logouts of conversing users are deferred by sessionDeferral at a time
+const sessionDeferral = 5 * time.Minute
+
+// Polling runs hold the reaper lease so they don't overlap, renewing it every leaseDuration/3. Each run also claims the
+// records it processes (until the lambda deadline, or claimDuration without one) in case a per-user reap or a run that
+// lost the lease picks up the same users.
+const (
+	reaperLeaseName = "reaper"
+	leaseDuration   = 60 * time.Second
+	claimDuration   = 2 * time.Minute
 )
 
 func main() {
-	lambda.Start(handleRequestLogger)
+	db.SetStore(db.NewDynamoDBStoreFromEnv())
+	db.SetScheduler(scheduler.FromEnv())
+	gc := genesys.NewClientFromEnv()
+	requestBudget := genesys.RequestBudgetFromEnv()
+	lambda.Start(func(ctx context.Context, request ReapRequest) error {
+		ctx = genesys.WithRequestBudget(ctx, requestBudget)
+		return handleRequestLogger(ctx, gc, request)
+	})
+}
+
+// ReapRequest is the input of a per-user reap schedule; the polling schedule sends a request without a user ID
+type ReapRequest struct {
+	UserID string `json:"userId"`
 }
 
-func handleRequestLogger() error {
-	err := handleRequest()
+func handleRequestLogger(ctx context.Context, gc genesys.Client, request ReapRequest) error {
+	err := handleRequest(ctx, gc, request)
 	if err != nil {
 		log.Printf("Error handling request: %v", err)
 	}
 	return err
 }
 
-func handleRequest() error {
+func handleRequest(ctx context.Context, gc genesys.Client, request ReapRequest) error {
 	now := time.Now().UnixMilli()
-	fmt.Printf("Reaping entries before %d\n", now)
+	owner := invocationID(ctx)
 
-	uaList, err := db.ListUserActivity(true, &now)
-	if err != nil {
-		return fmt.Errorf("failed to list UserActivity: %v", err)
+	var uaList []db.UserActivity
+	if request.UserID != "" {
+		// Single-user reap triggered by the user's schedule
+		fmt.Printf("Reaping user %s\n", request.UserID)
+		ua, err := db.ReadUserActivity(request.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to read UserActivity: %v", err)
+		}
+		if ua == nil || !ua.IsDue(now) {
+			fmt.Printf("user %s is not due\n", request.UserID)
+			return nil
+		}
+		uaList = append(uaList, *ua)
+	} else {
+		// Only one polling run at a time
+		lease, err := db.AcquireLease(reaperLeaseName, owner, leaseDuration)
+		var held *db.LeaseHeldError
+		if errors.As(err, &held) {
+			fmt.Printf("Another reaper run is in progress: %v\n", held)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to acquire reaper lease: %v", err)
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		stopHeartbeat := heartbeat(ctx, cancel, lease)
+		defer func() {
+			stopHeartbeat()
+			cancel()
+			if err := db.ReleaseLease(lease); err != nil {
+				fmt.Printf("failed to release reaper lease: %v\n", err)
+			}
+		}()
+
+		fmt.Printf("Reaping entries before %d\n", now)
+		uaList, err = db.ListUserActivity(db.StatusPending, &now)
+		if err != nil {
+			return fmt.Errorf("failed to list UserActivity: %v", err)
+		}
+	}
+
+	return reap(ctx, gc, owner, uaList)
+}
+
+// invocationID identifies the lambda invocation as the owner of leases and claims
+func invocationID(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+	return fmt.Sprintf("local-%d", time.Now().UnixNano())
+}
+
+// heartbeat renews the lease until the returned stop function is called. If the lease is lost to another run, cancel
+// is called so that no new users are taken.
+func heartbeat(ctx context.Context, cancel context.CancelFunc, lease *db.Lease) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(leaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := db.RenewLease(lease, leaseDuration)
+				var held *db.LeaseHeldError
+				if errors.As(err, &held) {
+					fmt.Printf("lost the reaper lease, stopping: %v\n", held)
+					cancel()
+					return
+				}
+				if err != nil {
+					fmt.Printf("failed to renew reaper lease: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// errNotDue is returned when the user is no longer due by the time the reaper acts on them (e.g. activity arrived)
+var errNotDue = errors.New("user is no longer due")
+
+// reapSummary counts the outcome of a reaper run. Skipped users were found active in Genesys, not due users were no
+// longer due (or were claimed by another run) when they were reached, and deferred users were left for the next run
+// because the lambda deadline was close.
+type reapSummary struct {
+	mu        sync.Mutex
+	processed int
+	succeeded int
+	failed    int
+	skipped   int
+	notDue    int
+	deferred  int
+}
+
+// record counts the outcome of reaping a user
+func (s *reapSummary) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed++
+	switch {
+	case errors.Is(err, errNotDue):
+		s.notDue++
+	case err != nil:
+		s.failed++
+	default:
+		s.succeeded++
+	}
+}
+
+// count adds n users to one of the summary's counters; users that are not deferred are also counted as processed
+func (s *reapSummary) count(counter *int, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*counter += n
+	if counter != &s.deferred {
+		s.processed += n
+	}
+}
+
+func (s *reapSummary) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%d processed, %d succeeded, %d failed, %d skipped, %d not due, %d deferred",
+		s.processed, s.succeeded, s.failed, s.skipped, s.notDue, s.deferred)
+}
+
+// reap warns, logs out or records the dry-run logout of the due users. The users are split into batches among the
+// workers, which claim the users of a batch for the owner, verify them with one Genesys request and reap them. Users
+// that can't be started before the lambda deadline are left pending for the next run.
+func reap(ctx context.Context, gc genesys.Client, owner string, uaList []db.UserActivity) error {
+	summary := &reapSummary{}
+
+	// Claims last until the lambda deadline
+	until := time.Now().Add(claimDuration).UnixMilli()
+	if deadline, ok := ctx.Deadline(); ok {
+		until = deadline.UnixMilli()
+	}
+
+	var errMu sync.Mutex
+	var reapErr error
+	batches := make(chan []db.UserActivity)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := reapBatch(ctx, gc, owner, until, batch, summary); err != nil {
+					errMu.Lock()
+					reapErr = errors.Join(reapErr, err)
+					errMu.Unlock()
+				}
+			}
+		}()
+	}
+
+	// Spread the users over the workers, up to verifyBatchSize users per batch
+	batchSize := min(max((len(uaList)+workers-1)/workers, 1), verifyBatchSize)
+	for i := 0; i < len(uaList); i += batchSize {
+		if !hasTimeLeft(ctx) {
+			summary.count(&summary.deferred, len(uaList)-i)
+			fmt.Printf("lambda deadline is close, deferring %d users to the next run\n", len(uaList)-i)
+			break
+		}
+		batches <- uaList[i:min(i+batchSize, len(uaList))]
 	}
+	close(batches)
+	wg.Wait()
 
-	// Reauth if there are any pending user activities (the token can expire if the lambda function is kept warm for too long)
-	if len(uaList) > 0 {
-		err = genesys.Reauth()
+	if reapErr != nil {
+		fmt.Printf("Reaper run failed: %s\n", summary)
+		return reapErr
+	}
+	fmt.Printf("Reaper run finished: %s\n", summary)
+	return nil
+}
+
+// reapBatch claims the users of the batch so that no other reaper invocation processes them, re-verifies their live
+// Genesys state and reaps the users that are still inactive. If the live state can't be fetched, the claims are
+// released so the users can be picked up again right away.
+func reapBatch(ctx context.Context, gc genesys.Client, owner string, until int64, batch []db.UserActivity, summary *reapSummary) error {
+	var claimedList []db.UserActivity
+	for i, ua := range batch {
+		if !hasTimeLeft(ctx) {
+			summary.count(&summary.deferred, len(batch)-i)
+			break
+		}
+		claimed, err := db.ClaimUserActivity(ua, owner, until)
 		if err != nil {
-			return fmt.Errorf("failed to reauth Genesys: %v", err)
+			fmt.Printf("failed to claim user %s: %v\n", ua.UserID, err)
+			summary.count(&summary.failed, 1)
+			continue
+		}
+		if claimed == nil {
+			fmt.Printf("user %s is no longer due or is claimed by another run\n", ua.UserID)
+			summary.count(&summary.notDue, 1)
+			continue
 		}
+		claimedList = append(claimedList, *claimed)
 	}
 
-	// Logout all pending user activities
-	fmt.Printf("Logging out %d users\n", len(uaList))
-	for _, ua := range uaList {
-		err = genesys.LogoutUser(ua.UserID)
+	if len(claimedList) == 0 {
+		return nil
+	}
+
+	// Re-verify the live Genesys state in case presence or conversation events were lost or are late
+	verifiedList, err := verifyLiveState(ctx, gc, claimedList)
+	if err != nil {
+		for _, ua := range claimedList {
+			if err := db.ReleaseUserActivityClaim(ua, owner); err != nil {
+				fmt.Printf("failed to release claim on user %s: %v\n", ua.UserID, err)
+			}
+		}
+		summary.count(&summary.failed, len(claimedList))
+		return fmt.Errorf("failed to verify live Genesys state: %v", err)
+	}
+
+	// Skipped users were handled by verifyLiveState
+	summary.count(&summary.skipped, len(claimedList)-len(verifiedList))
+
+	for i, ua := range verifiedList {
+		if !hasTimeLeft(ctx) {
+			// Their claims expire at the lambda deadline
+			summary.count(&summary.deferred, len(verifiedList)-i)
+			break
+		}
+		summary.record(reapUser(ctx, gc, ua))
+	}
+	return nil
+}
+
+// hasTimeLeft checks if there is time to reap another user before the lambda deadline
+func hasTimeLeft(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > deadlineMargin
+}
+
+// reapUser enforces the max session length or the ACW policy, re-evaluates the timeout at a schedule boundary, warns
+// the user if they have not been warned yet, records the would-be enforcement action in dry-run mode, or enforces it.
+// errNotDue is returned if the user is no longer due by the time their record is written.
+func reapUser(ctx context.Context, gc genesys.Client, ua db.UserActivity) error {
+	if ua.IsSessionDue(time.Now().UnixMilli()) {
+		return enforceSession(ctx, gc, ua)
+	}
+	if ua.ACWDeadline != nil {
+		return enforceACW(ctx, gc, ua)
+	}
+	if ua.ScheduleBoundary {
+		return reevaluateSchedule(ua)
+	}
+	if ua.NeedsWarning() {
+		return warnUser(ctx, ua)
+	}
+	if isDryRun(ua) {
+		return recordDryRun(ua)
+	}
+	return enforce(ctx, gc, ua)
+}
+
+// reevaluateSchedule re-arms the TTL of a user whose TTL was capped at a business-hours schedule boundary
+func reevaluateSchedule(ua db.UserActivity) error {
+	owner := ua.ClaimedBy
+	reevaluated := false
+	err := db.SaveUserActivityChange(ua, func(ua *db.UserActivity) bool {
+		if !ua.IsDue(time.Now().UnixMilli()) || ua.ClaimedBy != owner || !ua.ScheduleBoundary {
+			return false
+		}
+		ua.ReevaluateSchedule()
+		if ua.InactivityTTL != nil {
+			fmt.Printf("re-evaluated timeout of user %s at schedule boundary, next deadline %d\n", ua.UserID, *ua.InactivityTTL)
+		}
+		reevaluated = true
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to write user activity after schedule boundary: %v\n", err)
+		return err
+	}
+	if !reevaluated {
+		return errNotDue
+	}
+	return nil
+}
+
+// enforce applies the current escalation ladder step of the user, or records the failure so it is retried with backoff
+func enforce(ctx context.Context, gc genesys.Client, ua db.UserActivity) error {
+	stepIndex := ua.LadderStep
+	action := ua.CurrentStep().Action
+
+	err := applyEnforcementAction(ctx, gc, ua, action)
+	if err != nil {
+		// Keep the TTL so the action is retried on a later run
+		fmt.Printf("failed to %s Genesys user: %v\n", action, err)
+		return recordEnforcementFailure(ua, action, err)
+	}
+
+	// Record the action with the state the decision was made on
+	fmt.Printf("applied %s to Genesys user: %s\n", action, ua.UserID)
+	event := db.NewReaperEvent(ua, db.ReaperEventEnforced, inactivityReason(ua))
+	event.Enforcement = action
+
+	// Move the user to the next step, or clear the inactivity TTL after the last one. Activity since the record was
+	// claimed (even if the user was logged out) re-armed the TTL from the new state, which is kept.
+	owner := ua.ClaimedBy
+	completed := false
+	err = db.SaveUserActivityChange(ua, func(ua *db.UserActivity) bool {
+		if ua.LadderStep != stepIndex || !ua.IsDue(time.Now().UnixMilli()) || ua.ClaimedBy != owner {
+			completed = false
+			return false
+		}
+		ua.CompleteStep(enforcedPresence(action))
+		completed = true
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to write user activity after %s: %v\n", action, err)
+		return err
+	}
+	if !completed {
+		// The record is only moved on (and the action recorded) by the run that still holds the due record
+		fmt.Printf("applied %s to Genesys user %s, but the record was no longer due or claimed\n", action, ua.UserID)
+		return errNotDue
+	}
+
+	err = db.WriteReaperEvent(event)
+	if err != nil {
+		fmt.Printf("failed to write enforced event: %v\n", err)
+	}
+	return err
+}
+
+// recordEnforcementFailure records the failed action so it is retried with backoff, and returns the action's error
+func recordEnforcementFailure(ua db.UserActivity, action string, actionErr error) error {
+	owner := ua.ClaimedBy
+	err := db.SaveUserActivityChange(ua, func(ua *db.UserActivity) bool {
+		if !ua.IsDue(time.Now().UnixMilli()) || ua.ClaimedBy != owner {
+			return false
+		}
+		ua.RecordLogoutFailure(actionErr, maxLogoutAttempts, logoutRetryDelay, maxLogoutRetryDelay)
+		ua.ReleaseClaim()
+		if ua.LogoutFailedAt != nil {
+			fmt.Printf("giving up on %s of Genesys user %s after %d attempts\n", action, ua.UserID, ua.LogoutAttempts)
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to write user activity after failed %s: %v\n", action, err)
+	}
+	return actionErr
+}
+
+// enforceSession logs out a user whose session reached the max session length of their timeout group, or records the
+// would-be logout in dry-run mode
+func enforceSession(ctx context.Context, gc genesys.Client, ua db.UserActivity) error {
+	group, _ := groupconfig.GetTimeoutGroup(ua.GroupID)
+	reason := fmt.Sprintf("session longer than %d minutes", group.MaxSessionMinutes)
+
+	eventAction := db.ReaperEventEnforced
+	if isDryRun(ua) {
+		fmt.Printf("dry run, not logging out Genesys user %s: %s\n", ua.UserID, reason)
+		eventAction = db.ReaperEventDryRun
+	} else {
+		err := applyEnforcementAction(ctx, gc, ua, groupconfig.ActionLogout)
 		if err != nil {
 			fmt.Printf("failed to logout Genesys user: %v\n", err)
+			return recordEnforcementFailure(ua, groupconfig.ActionLogout, err)
+		}
+		fmt.Printf("logged out Genesys user %s: %s\n", ua.UserID, reason)
+	}
+
+	// Record the logout with the state the decision was made on
+	event := db.NewReaperEvent(ua, eventAction, reason)
+	event.Enforcement = groupconfig.ActionLogout
+
+	owner := ua.ClaimedBy
+	sessionStartedAt := ua.SessionStartedAt
+	completed := false
+	err := db.SaveUserActivityChange(ua, func(ua *db.UserActivity) bool {
+		// The session ended or the claim was lost since the record was claimed
+		if ua.SessionStartedAt == nil || sessionStartedAt == nil || *ua.SessionStartedAt != *sessionStartedAt ||
+			ua.SessionEnforcedAt != nil || ua.ClaimedBy != owner {
+			completed = false
+			return false
+		}
+		ua.CompleteSession()
+		completed = true
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to write user activity after session logout: %v\n", err)
+		return err
+	}
+	if !completed {
+		fmt.Printf("session of Genesys user %s ended or was claimed by another run before the record was written\n", ua.UserID)
+		return errNotDue
+	}
+
+	err = db.WriteReaperEvent(event)
+	if err != nil {
+		fmt.Printf("failed to write session logout event: %v\n", err)
+	}
+	return err
+}
+
+// enforceACW takes the ACW policy action on a user who has been conversing only through after-call work for too long,
+// or records the would-be action in dry-run mode. The action is taken once per ACW period.
+func enforceACW(ctx context.Context, gc genesys.Client, ua db.UserActivity) error {
+	group, _ := groupconfig.GetTimeoutGroup(ua.GroupID)
+	if group.ACWPolicy == nil {
+		// The policy was removed after the deadline was set
+		return completeACWPolicy(ua, nil)
+	}
+	action := group.ACWPolicy.EnforcementAction()
+	reason := fmt.Sprintf("in after-call work only for %d minutes", group.ACWPolicy.MaxMinutes)
+
+	eventAction := db.ReaperEventEnforced
+	if isDryRun(ua) {
+		fmt.Printf("dry run, not applying %s to Genesys user %s: %s\n", action, ua.UserID, reason)
+		eventAction = db.ReaperEventDryRun
+	} else {
+		var err error
+		if action == groupconfig.ActionNotify {
+			err = notifier.NotifyStuckInACW(ctx, notify.StuckInACW{
+				UserID:     ua.UserID,
+				GroupID:    ua.GroupID,
+				ACWSince:   *ua.ACWSince,
+				MaxMinutes: group.ACWPolicy.MaxMinutes,
+			})
 		} else {
-			fmt.Printf("logged out Genesys user: %s\n", ua.UserID)
+			err = applyEnforcementAction(ctx, gc, ua, action)
 		}
-		err = db.WriteUserActivity(ua, true)
 		if err != nil {
-			fmt.Printf("failed to write user activity after logout: %v\n", err)
+			fmt.Printf("failed to %s Genesys user: %v\n", action, err)
+			return recordEnforcementFailure(ua, action, err)
 		}
+		fmt.Printf("applied %s to Genesys user %s: %s\n", action, ua.UserID, reason)
 	}
 
-	return nil
+	// Record the action with the state the decision was made on
+	event := db.NewReaperEvent(ua, eventAction, reason)
+	event.Enforcement = action
+	return completeACWPolicy(ua, &event)
+}
+
+// completeACWPolicy marks the ACW policy as enforced for the user's current ACW period and writes the reaper event, if
+// any
+func completeACWPolicy(ua db.UserActivity, event *db.ReaperEvent) error {
+	owner := ua.ClaimedBy
+	acwSince := ua.ACWSince
+	completed := false
+	err := db.SaveUserActivityChange(ua, func(ua *db.UserActivity) bool {
+		// The user left ACW or the claim was lost since the record was claimed
+		if ua.ACWSince == nil || acwSince == nil || *ua.ACWSince != *acwSince || ua.ACWEnforcedAt != nil ||
+			ua.ClaimedBy != owner {
+			completed = false
+			return false
+		}
+		ua.CompleteACWPolicy()
+		completed = true
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to write user activity after ACW policy: %v\n", err)
+		return err
+	}
+	if !completed {
+		fmt.Printf("Genesys user %s left after-call work or was claimed by another run before the record was written\n", ua.UserID)
+		return errNotDue
+	}
+
+	if event == nil {
+		return nil
+	}
+	err = db.WriteReaperEvent(*event)
+	if err != nil {
+		fmt.Printf("failed to write ACW policy event: %v\n", err)
+	}
+	return err
+}
+
+// applyEnforcementAction takes the enforcement action on the user in Genesys
+func applyEnforcementAction(ctx context.Context, gc genesys.Client, ua db.UserActivity, action string) error {
+	switch action {
+	case groupconfig.ActionPresenceOffline:
+		return gc.SetPresence(ctx, ua.UserID, genesys.SystemPresenceOffline)
+	case groupconfig.ActionPresenceAway:
+		return gc.SetPresence(ctx, ua.UserID, genesys.SystemPresenceAway)
+	case groupconfig.ActionOffQueue:
+		return gc.SetRoutingStatus(ctx, ua.UserID, genesys.RoutingStatusOffQueue)
+	case groupconfig.ActionNotify:
+		inactivity := notify.Inactivity{
+			UserID:  ua.UserID,
+			GroupID: ua.GroupID,
+		}
+		if ua.InactivityTTL != nil {
+			inactivity.InactivityTTL = *ua.InactivityTTL
+		}
+		return notifier.NotifyInactive(ctx, inactivity)
+	default:
+		return gc.LogoutUser(ctx, ua.UserID)
+	}
+}
+
+// enforcedPresence returns the system presence the action puts the user in, if any
+func enforcedPresence(action string) string {
+	switch action {
+	case groupconfig.ActionPresenceOffline:
+		return genesys.SystemPresenceOffline
+	case groupconfig.ActionPresenceAway:
+		return genesys.SystemPresenceAway
+	default:
+		return ""
+	}
+}
+
+// inactivityReason describes why the reaper acts on the user
+func inactivityReason(ua db.UserActivity) string {
+	group, _ := groupconfig.GetTimeoutGroup(ua.GroupID)
+	reason := fmt.Sprintf("inactive for %d minutes with presence %s", ua.CurrentStep().AfterMinutes, ua.Presence)
+	if condition, _, minutes, ok := ua.InactivityCondition(); ok && ua.LadderStep == 0 {
+		reason = fmt.Sprintf("%s for %d minutes with presence %s", condition, minutes, ua.Presence)
+	}
+	if ladder := group.Ladder(); len(ladder) > 1 {
+		reason += fmt.Sprintf(" (step %d of %d)", min(ua.LadderStep, len(ladder)-1)+1, len(ladder))
+	}
+	return reason
+}
+
+// verifyLiveState fetches the users' live presence and conversations from Genesys and re-runs the activity rules.
+// Users that are actually active are skipped and re-armed; the rest are returned for the reaper to act on.
+func verifyLiveState(ctx context.Context, gc genesys.Client, uaList []db.UserActivity) ([]db.UserActivity, error) {
+	userIDs := make([]string, len(uaList))
+	for i, ua := range uaList {
+		userIDs[i] = ua.UserID
+	}
+
+	users, err := gc.GetUsers(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var verifiedList []db.UserActivity
+	for _, ua := range uaList {
+		user, ok := users[ua.UserID]
+		if !ok {
+			fmt.Printf("Genesys user %s not found, using stored state\n", ua.UserID)
+			verifiedList = append(verifiedList, ua)
+			continue
+		}
+
+		// Apply the live state to a copy of the record. Writes apply it again to the record they change, which is the
+		// stored record if it was updated meanwhile.
+		live := ua
+		live.ApplyLiveState(*user)
+
+		var reason string
+		if ua.IsSessionDue(time.Now().UnixMilli()) {
+			// The session logout waits for the conversation to end
+			if live.SessionStartedAt != nil && live.Conversing {
+				fmt.Printf("deferring session logout of Genesys user %s while %s\n", ua.UserID, live.ExemptReason())
+				err = db.SaveUserActivityChange(ua, func(stored *db.UserActivity) bool {
+					if stored.ClaimedBy != ua.ClaimedBy {
+						return false
+					}
+					stored.ApplyLiveState(*user)
+					stored.DeferSession(time.Now().Add(sessionDeferral))
+					return true
+				})
+				if err != nil {
+					fmt.Printf("failed to write user activity after deferring session logout: %v\n", err)
+				}
+				continue
+			}
+			if live.SessionStartedAt != nil {
+				verifiedList = append(verifiedList, ua)
+				continue
+			}
+			reason = "session ended since the last event"
+		} else if ua.ACWDeadline != nil {
+			// The ACW policy applies as long as the user is still in after-call work only
+			if live.ACWSince != nil {
+				verifiedList = append(verifiedList, ua)
+				continue
+			}
+			reason = "no longer in after-call work"
+		} else {
+			// Staying in the presence set by a ladder step is not activity
+			if live.InEnforcedState() {
+				verifiedList = append(verifiedList, ua)
+				continue
+			}
+
+			reason = live.ExemptReason()
+			if reason == "" && live.SecondaryPresenceID != ua.SecondaryPresenceID {
+				reason = fmt.Sprintf("presence changed from %s to %s since the last event", ua.Presence, live.Presence)
+			}
+			if reason == "" {
+				verifiedList = append(verifiedList, ua)
+				continue
+			}
+		}
+
+		// The user is active, skip the logout and re-arm the TTL from the live state
+		fmt.Printf("skipping logout of Genesys user %s: %s\n", ua.UserID, reason)
+		err = db.WriteReaperEvent(db.NewReaperEvent(live, db.ReaperEventSkipped, reason))
+		if err != nil {
+			fmt.Printf("failed to write skipped event: %v\n", err)
+		}
+		err = db.SaveUserActivityChange(ua, func(stored *db.UserActivity) bool {
+			// Another run claimed the record after this run's claim expired
+			if stored.ClaimedBy != ua.ClaimedBy {
+				return false
+			}
+			stored.ApplyLiveState(*user)
+			stored.CheckActivity()
+			stored.ReleaseClaim()
+			return true
+		})
+		if err != nil {
+			fmt.Printf("failed to write user activity after skipping logout: %v\n", err)
+		}
+	}
+
+	return verifiedList, nil
+}
+
+// warnUser sends the pre-logout warning and marks the user as warned so they are logged out when the grace period ends
+func warnUser(ctx context.Context, ua db.UserActivity) error {
+	// Mark the user as warned first, unless activity arrived or the claim was lost since the record was claimed
+	owner := ua.ClaimedBy
+	warned := false
+	err := db.SaveUserActivityChange(ua, func(stored *db.UserActivity) bool {
+		if !stored.IsDue(time.Now().UnixMilli()) || !stored.NeedsWarning() || stored.ClaimedBy != owner {
+			return false
+		}
+		stored.MarkWarned()
+		stored.ReleaseClaim()
+		ua = *stored
+		warned = true
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to write user activity after warning: %v\n", err)
+		return err
+	}
+	if !warned {
+		fmt.Printf("user %s is no longer due a warning\n", ua.UserID)
+		return errNotDue
+	}
+
+	group, _ := groupconfig.GetTimeoutGroup(ua.GroupID)
+	if isDryRun(ua) {
+		fmt.Printf("dry run, not sending warning to user %s\n", ua.UserID)
+	} else {
+		err = notifier.Warn(ctx, notify.Warning{
+			UserID:        ua.UserID,
+			GroupID:       ua.GroupID,
+			InactivityTTL: *ua.InactivityTTL,
+			GraceMinutes:  group.WarningMinutes,
+		})
+	}
+	if err != nil {
+		// The user is still marked as warned so a broken notifier can't keep them logged in forever
+		fmt.Printf("failed to warn user %s: %v\n", ua.UserID, err)
+	} else {
+		fmt.Printf("warned user %s\n", ua.UserID)
+	}
+	return err
+}
+
+// isDryRun checks if the deployment or the user's timeout group is in dry-run mode
+func isDryRun(ua db.UserActivity) bool {
+	if dryRun {
+		return true
+	}
+	group, ok := groupconfig.GetTimeoutGroup(ua.GroupID)
+	return ok && group.DryRun
+}
+
+// recordDryRun records the ladder step that would have been applied and moves the user on as if it had been
+func recordDryRun(ua db.UserActivity) error {
+	action := ua.CurrentStep().Action
+	reason := inactivityReason(ua)
+	fmt.Printf("dry run, not applying %s to Genesys user %s: %s\n", action, ua.UserID, reason)
+
+	// Record the event with the state the decision was made on
+	event := db.NewReaperEvent(ua, db.ReaperEventDryRun, reason)
+	event.Enforcement = action
+
+	owner := ua.ClaimedBy
+	stepIndex := ua.LadderStep
+	recorded := false
+	err := db.SaveUserActivityChange(ua, func(ua *db.UserActivity) bool {
+		if !ua.IsDue(time.Now().UnixMilli()) || ua.ClaimedBy != owner || ua.LadderStep != stepIndex {
+			return false
+		}
+		// Nothing was changed in Genesys, so no presence is enforced
+		ua.CompleteStep("")
+		recorded = true
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to write user activity after dry run: %v\n", err)
+		return err
+	}
+	if !recorded {
+		fmt.Printf("user %s is no longer due a logout\n", ua.UserID)
+		return errNotDue
+	}
+
+	err = db.WriteReaperEvent(event)
+	if err != nil {
+		fmt.Printf("failed to write dry run event: %v\n", err)
+	}
+	return err
+}
+
+// envInt reads a positive integer from the environment, or returns the default
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
 }
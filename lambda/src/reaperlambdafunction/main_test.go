@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	"user-activity-monitor/src/apitypes"
+	"user-activity-monitor/src/db"
+	"user-activity-monitor/src/genesys"
+	"user-activity-monitor/src/groupconfig"
+	"user-activity-monitor/src/notify"
+	"user-activity-monitor/src/scheduler"
+)
+
+const (
+	testGroupID         = "0f6c1b4e-3d2a-4c8e-9b7f-5a1d2e3f4a5b"
+	testUserID          = "7d3e2c1b-4a5f-4e6d-8c7b-9a0f1e2d3c4b"
+	availablePresenceID = "6a3af858-942f-489d-9700-5f9bcdcdae9b"
+)
+
+// recordingNotifier records the warnings instead of sending them
+type recordingNotifier struct {
+	mu       sync.Mutex
+	warnings []notify.Warning
+}
+
+func (n *recordingNotifier) Warn(ctx context.Context, warning notify.Warning) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.warnings = append(n.warnings, warning)
+	return nil
+}
+
+func (n *recordingNotifier) NotifyInactive(ctx context.Context, inactivity notify.Inactivity) error {
+	return nil
+}
+
+func (n *recordingNotifier) NotifyStuckInACW(ctx context.Context, acw notify.StuckInACW) error {
+	return nil
+}
+
+// setup runs the reaper against in-memory backends with the timeout group, and returns the fake Genesys client with
+// the test user online in the group
+func setup(t *testing.T, group groupconfig.TimeoutGroup) (*genesys.FakeClient, *scheduler.MemoryScheduler, *recordingNotifier) {
+	t.Helper()
+
+	db.SetStore(db.NewMemoryStore())
+	reapScheduler := scheduler.NewMemoryScheduler()
+	db.SetScheduler(reapScheduler)
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{testGroupID: group})
+
+	previousNotifier := notifier
+	recorder := &recordingNotifier{}
+	notifier = recorder
+	t.Cleanup(func() {
+		notifier = previousNotifier
+		db.SetScheduler(nil)
+	})
+
+	gc := genesys.NewFakeClient()
+	gc.Users[testUserID] = &genesys.GenesysUser{
+		ID:     testUserID,
+		Name:   "Test User",
+		Groups: []genesys.GenesysGroup{{ID: testGroupID}},
+		Presence: apitypes.PresenceEventBody{
+			PresenceDefinition: apitypes.PresenceDefinition{ID: availablePresenceID, SystemPresence: "Available"},
+		},
+	}
+	return gc, reapScheduler, recorder
+}
+
+// storeInactiveUser writes the record of the inactive test user with the inactivity TTL, as the monitor would have
+func storeInactiveUser(t *testing.T, ttl time.Time) {
+	t.Helper()
+
+	ua := db.UserActivity{
+		UserID:              testUserID,
+		Presence:            "AVAILABLE",
+		SecondaryPresenceID: availablePresenceID,
+		GroupID:             testGroupID,
+		InactivityTTL:       &[]int64{ttl.UnixMilli()}[0],
+		InactiveSince:       &[]int64{time.Now().UnixMilli()}[0],
+	}
+	if err := db.SaveUserActivity(ua); err != nil {
+		t.Fatalf("failed to store user activity: %v", err)
+	}
+}
+
+// expire moves the deadline set by the change to just ahead and waits for it to pass, as if the time had gone by.
+// Records are listed by the status they were written with, so the deadline can't be written in the past.
+func expire(t *testing.T, change func(ua *db.UserActivity, deadline int64)) {
+	t.Helper()
+
+	ua := readUser(t)
+	deadline := time.Now().Add(20 * time.Millisecond).UnixMilli()
+	err := db.SaveUserActivityChange(*ua, func(ua *db.UserActivity) bool {
+		change(ua, deadline)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("failed to write user activity: %v", err)
+	}
+	time.Sleep(40 * time.Millisecond)
+}
+
+func readUser(t *testing.T) *db.UserActivity {
+	t.Helper()
+
+	ua, err := db.ReadUserActivity(testUserID)
+	if err != nil {
+		t.Fatalf("failed to read user activity: %v", err)
+	}
+	if ua == nil {
+		t.Fatal("user activity not found")
+	}
+	return ua
+}
+
+// runReaper runs a polling reaper invocation
+func runReaper(t *testing.T, gc genesys.Client) {
+	t.Helper()
+
+	if err := handleRequest(context.Background(), gc, ReapRequest{}); err != nil {
+		t.Fatalf("reaper run failed: %v", err)
+	}
+}
+
+// fireSchedules runs the per-user reaps of the due schedules, which are deleted once they fire, and returns the IDs of
+// the users reaped
+func fireSchedules(t *testing.T, gc genesys.Client, reapScheduler *scheduler.MemoryScheduler) []string {
+	t.Helper()
+
+	userIDs := reapScheduler.Due(time.Now())
+	for _, userID := range userIDs {
+		if err := handleRequest(context.Background(), gc, ReapRequest{UserID: userID}); err != nil {
+			t.Fatalf("reap of user %s failed: %v", userID, err)
+		}
+	}
+	return userIDs
+}
+
+func listReaperEvents(t *testing.T, action string) []db.ReaperEvent {
+	t.Helper()
+
+	events, err := db.ListReaperEvents(action, time.Now().Add(-time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatalf("failed to list reaper events: %v", err)
+	}
+	return events
+}
+
+func TestReapWarnsThenLogsOut(t *testing.T) {
+	gc, reapScheduler, recorder := setup(t, groupconfig.TimeoutGroup{
+		Name:           "Timeout Group - test",
+		TimeoutMinutes: 15,
+		WarningMinutes: 5,
+	})
+
+	// The warning is due 5 minutes before the TTL
+	storeInactiveUser(t, time.Now().Add(2*time.Minute))
+	runReaper(t, gc)
+
+	ua := readUser(t)
+	if ua.WarnedAt == nil {
+		t.Fatal("user was not marked as warned")
+	}
+	if len(recorder.warnings) != 1 {
+		t.Fatalf("got %d warnings, want 1", len(recorder.warnings))
+	}
+	if len(gc.LoggedOut) != 0 {
+		t.Fatalf("user was logged out before the grace period ended: %v", gc.LoggedOut)
+	}
+	graceEnd := time.Now().Add(5 * time.Minute).Add(-time.Minute).UnixMilli()
+	if ua.InactivityTTL == nil || *ua.InactivityTTL < graceEnd {
+		t.Fatalf("inactivity TTL %v doesn't leave the grace period after the warning", ua.InactivityTTL)
+	}
+	if at, ok := reapScheduler.Get(testUserID); !ok || at.UnixMilli() != *ua.InactivityTTL {
+		t.Errorf("reap schedule = %v (%v), want the inactivity TTL %d", at, ok, *ua.InactivityTTL)
+	}
+
+	// The grace period ends, and the user's schedule fires
+	expire(t, func(ua *db.UserActivity, deadline int64) {
+		ua.InactivityTTL = &deadline
+	})
+	if userIDs := fireSchedules(t, gc, reapScheduler); len(userIDs) != 1 || userIDs[0] != testUserID {
+		t.Fatalf("fired schedules of %v, want %s", userIDs, testUserID)
+	}
+
+	if len(gc.LoggedOut) != 1 || gc.LoggedOut[0] != testUserID {
+		t.Fatalf("logged out %v, want %s", gc.LoggedOut, testUserID)
+	}
+	ua = readUser(t)
+	if ua.InactivityTTL != nil || ua.WarnedAt != nil {
+		t.Errorf("inactivity TTL and warning were not cleared after the logout")
+	}
+	if ua.Status() != db.StatusExempt {
+		t.Errorf("status = %s, want %s", ua.Status(), db.StatusExempt)
+	}
+	if _, ok := reapScheduler.Get(testUserID); ok {
+		t.Error("user was rescheduled after the logout")
+	}
+	if events := listReaperEvents(t, db.ReaperEventEnforced); len(events) != 1 || events[0].Enforcement != groupconfig.ActionLogout {
+		t.Errorf("enforced events = %+v, want one logout", events)
+	}
+	if len(recorder.warnings) != 1 {
+		t.Errorf("got %d warnings, want 1", len(recorder.warnings))
+	}
+}
+
+func TestReapDryRun(t *testing.T) {
+	gc, _, _ := setup(t, groupconfig.TimeoutGroup{
+		Name:           "Timeout Group - test",
+		TimeoutMinutes: 15,
+		DryRun:         true,
+	})
+
+	storeInactiveUser(t, time.Now().Add(time.Hour))
+	expire(t, func(ua *db.UserActivity, deadline int64) {
+		ua.InactivityTTL = &deadline
+	})
+	runReaper(t, gc)
+
+	if len(gc.LoggedOut) != 0 {
+		t.Fatalf("user was logged out in dry-run mode: %v", gc.LoggedOut)
+	}
+	events := listReaperEvents(t, db.ReaperEventDryRun)
+	if len(events) != 1 || events[0].UserID != testUserID || events[0].Enforcement != groupconfig.ActionLogout {
+		t.Fatalf("dry-run events = %+v, want one logout of %s", events, testUserID)
+	}
+	if events := listReaperEvents(t, db.ReaperEventEnforced); len(events) != 0 {
+		t.Errorf("enforced events = %+v, want none", events)
+	}
+
+	// The user is moved on as if they had been logged out
+	ua := readUser(t)
+	if ua.InactivityTTL != nil {
+		t.Errorf("inactivity TTL = %d, want it cleared", *ua.InactivityTTL)
+	}
+	if ua.ClaimedBy != "" {
+		t.Errorf("record is still claimed by %s", ua.ClaimedBy)
+	}
+}
+
+func TestReapRetriesFailedLogoutWithBackoff(t *testing.T) {
+	gc, reapScheduler, _ := setup(t, groupconfig.TimeoutGroup{
+		Name:           "Timeout Group - test",
+		TimeoutMinutes: 15,
+	})
+	gc.LogoutErrors[testUserID] = errors.New("failed to logout user: 503 Service Unavailable")
+
+	previousMaxLogoutAttempts := maxLogoutAttempts
+	maxLogoutAttempts = 2
+	t.Cleanup(func() { maxLogoutAttempts = previousMaxLogoutAttempts })
+
+	storeInactiveUser(t, time.Now().Add(time.Hour))
+	expire(t, func(ua *db.UserActivity, deadline int64) {
+		ua.InactivityTTL = &deadline
+	})
+	runReaper(t, gc)
+
+	// The first failure is retried after the retry delay
+	ua := readUser(t)
+	if ua.LogoutAttempts != 1 || ua.LastLogoutError == "" {
+		t.Fatalf("logout attempts = %d, last error = %q, want 1 attempt with the error", ua.LogoutAttempts, ua.LastLogoutError)
+	}
+	minRetry := time.Now().Add(logoutRetryDelay).Add(-time.Minute).UnixMilli()
+	if ua.NextLogoutRetry == nil || *ua.NextLogoutRetry < minRetry {
+		t.Fatalf("next logout retry %v is not after the retry delay", ua.NextLogoutRetry)
+	}
+	if ua.Status() != db.StatusPending || ua.ClaimedBy != "" {
+		t.Errorf("status = %s, claimed by %q, want pending and unclaimed", ua.Status(), ua.ClaimedBy)
+	}
+	if at, ok := reapScheduler.Get(testUserID); !ok || at.UnixMilli() != *ua.NextLogoutRetry {
+		t.Errorf("reap schedule = %v (%v), want the next retry %d", at, ok, *ua.NextLogoutRetry)
+	}
+
+	// Nothing happens before the retry is due
+	runReaper(t, gc)
+	if ua := readUser(t); ua.LogoutAttempts != 1 {
+		t.Fatalf("logout attempts = %d before the retry was due, want 1", ua.LogoutAttempts)
+	}
+
+	// The last attempt fails too, and the user is given up on
+	expire(t, func(ua *db.UserActivity, deadline int64) {
+		ua.NextLogoutRetry = &deadline
+	})
+	runReaper(t, gc)
+
+	ua = readUser(t)
+	if ua.LogoutAttempts != 2 || ua.LogoutFailedAt == nil {
+		t.Fatalf("logout attempts = %d, failed at %v, want 2 attempts and failed", ua.LogoutAttempts, ua.LogoutFailedAt)
+	}
+	if ua.Status() != db.StatusFailed {
+		t.Errorf("status = %s, want %s", ua.Status(), db.StatusFailed)
+	}
+	if at, ok := reapScheduler.Get(testUserID); ok && at.After(time.Now()) {
+		t.Errorf("user was rescheduled at %v after giving up", at)
+	}
+	if len(gc.LoggedOut) != 0 {
+		t.Errorf("logged out %v, want none", gc.LoggedOut)
+	}
+}
+
+func TestEnforceAfterLosingClaim(t *testing.T) {
+	gc, _, _ := setup(t, groupconfig.TimeoutGroup{
+		Name:           "Timeout Group - test",
+		TimeoutMinutes: 15,
+	})
+
+	storeInactiveUser(t, time.Now().Add(time.Hour))
+	expire(t, func(ua *db.UserActivity, deadline int64) {
+		ua.InactivityTTL = &deadline
+	})
+
+	// The record was claimed by this run, but the claim expired and another run claimed it before the record was written
+	ua := readUser(t)
+	claimed := *ua
+	claimed.Claim("expired-run", time.Now().UnixMilli())
+	_, err := db.ClaimUserActivity(*ua, "other-run", time.Now().Add(time.Minute).UnixMilli())
+	if err != nil {
+		t.Fatalf("failed to claim user activity: %v", err)
+	}
+	err = enforce(context.Background(), gc, claimed)
+
+	if !errors.Is(err, errNotDue) {
+		t.Fatalf("enforce returned %v, want %v", err, errNotDue)
+	}
+	if len(gc.LoggedOut) != 1 {
+		t.Fatalf("logged out %v, want %s", gc.LoggedOut, testUserID)
+	}
+	if events := listReaperEvents(t, db.ReaperEventEnforced); len(events) != 0 {
+		t.Errorf("enforced events = %+v, want none for a record that was not moved on", events)
+	}
+	if ua := readUser(t); ua.InactivityTTL == nil {
+		t.Error("inactivity TTL of the record claimed by another run was cleared")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"user-activity-monitor/src/db"
+	"user-activity-monitor/src/genesys"
+	"user-activity-monitor/src/groupconfig"
+	"user-activity-monitor/src/scheduler"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+/**
+ * Reconciliation
+ *
+ * Users only get a UserActivity record from their first presence or conversation event, so users who were already
+ * logged in when the system was deployed, or whose events were lost (e.g. in an EventBridge outage), are not tracked.
+ * This scheduled job pages through the members of every configured timeout group, compares their live presence and
+ * conversations with the stored record, and creates or corrects the record the same way RefreshUser does. Records that
+ * match the live state are left alone, so their inactivity TTL keeps counting.
+ *
+ * It also picks up Genesys group membership changes, which don't send events: a user whose timeout group changed is
+ * moved to the new group, keeping the time they have already been inactive. Stored users who are no longer a member of
+ * any timeout group are looked up too, and are moved out of their timeout group. To bound each run, the stored records
+ * are checked a page at a time: the run carries on from a cursor stored by the previous one, and every record is
+ * checked once per pass through the pending, failed and exempt lists.
+ */
+
+// Users are no longer started when the lambda deadline is less than deadlineMargin away; the rest are reconciled on the
+// next run
+const deadlineMargin = 10 * time.Second
+
+// formerMembersCursor is the name of the cursor in the stored records checked for former timeout group members
+const formerMembersCursor = "reconcile-former-members"
+
+// formerMembersPageSize is the number of stored records checked for former timeout group members per run
+const formerMembersPageSize = 200
+
+// formerMembersStatuses are the user activity lists checked for former timeout group members, in order
+var formerMembersStatuses = []string{db.StatusPending, db.StatusFailed, db.StatusExempt}
+
+// Reconciliation outcomes of a user
+const (
+	outcomeCreated   = "created"
+	outcomeCorrected = "corrected"
+	outcomeUnchanged = "unchanged"
+)
+
+func main() {
+	db.SetStore(db.NewDynamoDBStoreFromEnv())
+	db.SetScheduler(scheduler.FromEnv())
+	gc := genesys.NewClientFromEnv()
+	requestBudget := genesys.RequestBudgetFromEnv()
+	lambda.Start(func(ctx context.Context) error {
+		ctx = genesys.WithRequestBudget(ctx, requestBudget)
+		return handleRequestLogger(ctx, gc)
+	})
+}
+
+func handleRequestLogger(ctx context.Context, gc genesys.Client) error {
+	err := handleRequest(ctx, gc)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+	}
+	return err
+}
+
+// reconcileSummary counts the outcome of a reconciliation run
+type reconcileSummary struct {
+	users        int
+	created      int
+	corrected    int
+	groupChanged int
+	unchanged    int
+	failed       int
+	deferred     int
+}
+
+func (s reconcileSummary) String() string {
+	return fmt.Sprintf("%d users, %d created, %d corrected, %d timeout group changes, %d unchanged, %d failed, %d deferred",
+		s.users, s.created, s.corrected, s.groupChanged, s.unchanged, s.failed, s.deferred)
+}
+
+func handleRequest(ctx context.Context, gc genesys.Client) error {
+	// Collect the members of every timeout group; users in several groups are reconciled once
+	groupIDs := make([]string, 0)
+	for groupID := range groupconfig.GetTimeoutGroups() {
+		groupIDs = append(groupIDs, groupID)
+	}
+	sort.Strings(groupIDs)
+
+	users := make(map[string]genesys.GenesysUser)
+	var userIDs []string
+	var failedGroups []string
+	for _, groupID := range groupIDs {
+		members, err := gc.GetGroupMembers(ctx, groupID)
+		if err != nil {
+			// Reconcile the other groups, the failed one is retried on the next run
+			fmt.Printf("failed to get members of timeout group %s: %v\n", groupID, err)
+			failedGroups = append(failedGroups, groupID)
+			continue
+		}
+		fmt.Printf("Timeout group %s has %d members\n", groupID, len(members))
+
+		for _, member := range members {
+			if _, ok := users[member.ID]; !ok {
+				userIDs = append(userIDs, member.ID)
+			}
+			users[member.ID] = member
+		}
+	}
+
+	// Users who left every timeout group are not in any member list. The lookup is skipped if a member list is
+	// missing, as its members would look like they left.
+	if len(failedGroups) == 0 {
+		formerMembers, err := getFormerMembers(ctx, gc, users)
+		if err != nil {
+			fmt.Printf("failed to get former timeout group members: %v\n", err)
+		}
+		for _, user := range formerMembers {
+			userIDs = append(userIDs, user.ID)
+			users[user.ID] = user
+		}
+	}
+
+	summary := reconcileSummary{users: len(userIDs)}
+	for i, userID := range userIDs {
+		if !hasTimeLeft(ctx) {
+			summary.deferred = len(userIDs) - i
+			fmt.Printf("lambda deadline is close, deferring %d users to the next run\n", summary.deferred)
+			break
+		}
+
+		outcome, groupChanged, err := reconcileUser(users[userID])
+		if err != nil {
+			fmt.Printf("failed to reconcile user %s: %v\n", userID, err)
+			summary.failed++
+			continue
+		}
+		if groupChanged {
+			summary.groupChanged++
+		}
+		switch outcome {
+		case outcomeCreated:
+			summary.created++
+		case outcomeCorrected:
+			summary.corrected++
+		default:
+			summary.unchanged++
+		}
+	}
+
+	fmt.Printf("Reconciliation finished: %s\n", summary)
+	if len(failedGroups) > 0 {
+		return fmt.Errorf("failed to get members of timeout groups %s", strings.Join(failedGroups, ", "))
+	}
+	return nil
+}
+
+// getFormerMembers looks up the stored users with a timeout group who are not among the members, in the next page of
+// stored records. The cursor is only moved on once the page has been looked up, so a failed page is retried.
+func getFormerMembers(ctx context.Context, gc genesys.Client, members map[string]genesys.GenesysUser) ([]genesys.GenesysUser, error) {
+	cursor, err := db.ReadCursor(formerMembersCursor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cursor: %w", err)
+	}
+	if cursor == nil || !slices.Contains(formerMembersStatuses, cursor.Status) {
+		cursor = &db.Cursor{Name: formerMembersCursor, Status: formerMembersStatuses[0]}
+	}
+
+	records, position, err := db.ListUserActivityPage(cursor.Status, cursor.Position, formerMembersPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s user activity: %w", cursor.Status, err)
+	}
+	fmt.Printf("Checking %d stored %s records for former timeout group members\n", len(records), cursor.Status)
+
+	var userIDs []string
+	for _, ua := range records {
+		if _, ok := members[ua.UserID]; !ok && ua.GroupID != "" {
+			userIDs = append(userIDs, ua.UserID)
+		}
+	}
+
+	var formerMembers []genesys.GenesysUser
+	if len(userIDs) > 0 {
+		users, err := gc.GetUsers(ctx, userIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, userID := range userIDs {
+			if user, ok := users[userID]; ok {
+				formerMembers = append(formerMembers, *user)
+			}
+		}
+	}
+
+	// Carry on with the next list after the last page
+	next := *cursor
+	next.Position = position
+	if position == "" {
+		next.Status = formerMembersStatuses[(slices.Index(formerMembersStatuses, cursor.Status)+1)%len(formerMembersStatuses)]
+	}
+	if err := db.WriteCursor(next); err != nil {
+		fmt.Printf("failed to write cursor: %v\n", err)
+	}
+
+	return formerMembers, nil
+}
+
+// reconcileUser creates the user's record if it doesn't exist, or corrects it if it drifted from the live state. A
+// timeout group change on its own keeps the time the user has been inactive.
+func reconcileUser(user genesys.GenesysUser) (outcome string, groupChanged bool, err error) {
+	stored, err := db.ReadUserActivity(user.ID)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read user activity: %w", err)
+	}
+
+	outcome = outcomeCreated
+	ua := db.UserActivity{UserID: user.ID}
+	if stored != nil {
+		drift := stored.Drift(user)
+		if len(drift) == 0 {
+			return outcomeUnchanged, false, nil
+		}
+		fmt.Printf("drift for user %s: %s\n", user.ID, strings.Join(drift, ", "))
+		outcome = outcomeCorrected
+		ua = *stored
+	}
+
+	// Events may have corrected the record in the meantime
+	applied := false
+	err = db.SaveUserActivityChange(ua, func(ua *db.UserActivity) bool {
+		applied = false
+		if len(ua.Drift(user)) == 0 {
+			return false
+		}
+		groupChanged = ua.ChangeTimeoutGroup(user)
+		// A lost routing status or station event alone doesn't reset the inactivity TTL
+		ua.ApplyInactivityConditions(user)
+		if len(ua.Drift(user)) > 0 {
+			ua.ApplyGenesysUser(user)
+		}
+		applied = true
+		return true
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to write user activity: %w", err)
+	}
+	if !applied {
+		return outcomeUnchanged, false, nil
+	}
+	// New records get their first timeout group, which is not a change
+	return outcome, groupChanged && stored != nil, nil
+}
+
+// hasTimeLeft checks if there is time to reconcile another user before the lambda deadline
+func hasTimeLeft(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > deadlineMargin
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+	"user-activity-monitor/src/apitypes"
+	"user-activity-monitor/src/db"
+	"user-activity-monitor/src/genesys"
+	"user-activity-monitor/src/groupconfig"
+)
+
+const (
+	testGroupID  = "0f6c1b4e-3d2a-4c8e-9b7f-5a1d2e3f4a5b"
+	otherGroupID = "3e4f5a6b-7c8d-4e9f-8a0b-1c2d3e4f5a6b"
+	testUserID   = "7d3e2c1b-4a5f-4e6d-8c7b-9a0f1e2d3c4b"
+)
+
+func TestGetFormerMembers(t *testing.T) {
+	db.SetStore(db.NewMemoryStore())
+	db.SetScheduler(nil)
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		testGroupID: {Name: "Timeout Group - test", TimeoutMinutes: 15},
+	})
+
+	// The user left the timeout group while offline
+	gc := genesys.NewFakeClient()
+	gc.Users[testUserID] = &genesys.GenesysUser{ID: testUserID, Name: "Test User"}
+	ua := db.UserActivity{UserID: testUserID, Presence: "OFFLINE", GroupID: testGroupID}
+	if err := db.SaveUserActivity(ua); err != nil {
+		t.Fatalf("failed to store user activity: %v", err)
+	}
+
+	// Each run checks one page, moving on to the next list after the last page of one
+	for _, status := range formerMembersStatuses {
+		formerMembers, err := getFormerMembers(context.Background(), gc, map[string]genesys.GenesysUser{})
+		if err != nil {
+			t.Fatalf("failed to get former members: %v", err)
+		}
+
+		want := 0
+		if status == db.StatusExempt {
+			want = 1
+		}
+		if len(formerMembers) != want {
+			t.Errorf("run checking %s records found former members %+v, want %d", status, formerMembers, want)
+		}
+	}
+
+	// The next run starts over
+	cursor, err := db.ReadCursor(formerMembersCursor)
+	if err != nil || cursor == nil {
+		t.Fatalf("cursor = %v (%v), want the stored cursor", cursor, err)
+	}
+	if cursor.Status != formerMembersStatuses[0] || cursor.Position != "" {
+		t.Errorf("cursor = %+v, want the start of the %s list", cursor, formerMembersStatuses[0])
+	}
+}
+
+func TestReconcileUser(t *testing.T) {
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		testGroupID:  {Name: "Timeout Group - test", TimeoutMinutes: 15},
+		otherGroupID: {Name: "Timeout Group - other", TimeoutMinutes: 30},
+	})
+
+	// The live state of the user, available in the test group
+	live := genesys.GenesysUser{
+		ID:     testUserID,
+		Name:   "Test User",
+		Groups: []genesys.GenesysGroup{{ID: testGroupID}},
+		Presence: apitypes.PresenceEventBody{
+			PresenceDefinition: apitypes.PresenceDefinition{ID: "6a3af858-942f-489d-9700-5f9bcdcdae9b", SystemPresence: "Available"},
+		},
+		RoutingStatus: apitypes.RoutingStatus{Status: "OFF_QUEUE"},
+	}
+	inSync := func() *db.UserActivity {
+		ua := db.UserActivity{UserID: testUserID}
+		ua.ApplyGenesysUser(live)
+		return &ua
+	}
+	inactiveSince := time.Now().Add(-10 * time.Minute).UnixMilli()
+
+	tests := []struct {
+		name             string
+		stored           *db.UserActivity
+		wantOutcome      string
+		wantGroupChanged bool
+		// wantTTLKept is set when the stored inactivity TTL must not be reset
+		wantTTLKept bool
+	}{
+		{
+			name:        "no record",
+			wantOutcome: outcomeCreated,
+		},
+		{
+			name:        "record in sync",
+			stored:      inSync(),
+			wantOutcome: outcomeUnchanged,
+			wantTTLKept: true,
+		},
+		{
+			name: "presence drift",
+			stored: func() *db.UserActivity {
+				ua := inSync()
+				ua.Presence = "AWAY"
+				return ua
+			}(),
+			wantOutcome: outcomeCorrected,
+		},
+		{
+			name: "routing status drift only",
+			stored: func() *db.UserActivity {
+				ua := inSync()
+				ua.RoutingStatus = "IDLE"
+				return ua
+			}(),
+			wantOutcome: outcomeCorrected,
+			wantTTLKept: true,
+		},
+		{
+			name: "timeout group changed",
+			stored: func() *db.UserActivity {
+				ua := inSync()
+				ua.GroupID = otherGroupID
+				ua.InactiveSince = &inactiveSince
+				ua.InactivityTTL = &[]int64{inactiveSince + (30 * time.Minute).Milliseconds()}[0]
+				return ua
+			}(),
+			wantOutcome:      outcomeCorrected,
+			wantGroupChanged: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetStore(db.NewMemoryStore())
+			db.SetScheduler(nil)
+			if tt.stored != nil {
+				if err := db.SaveUserActivity(*tt.stored); err != nil {
+					t.Fatalf("failed to store user activity: %v", err)
+				}
+			}
+
+			outcome, groupChanged, err := reconcileUser(live)
+			if err != nil {
+				t.Fatalf("failed to reconcile user: %v", err)
+			}
+			if outcome != tt.wantOutcome || groupChanged != tt.wantGroupChanged {
+				t.Errorf("outcome %s, group changed %v, want %s, %v", outcome, groupChanged, tt.wantOutcome, tt.wantGroupChanged)
+			}
+
+			ua, err := db.ReadUserActivity(testUserID)
+			if err != nil || ua == nil {
+				t.Fatalf("failed to read user activity: %v (%v)", ua, err)
+			}
+			if drift := ua.Drift(live); len(drift) > 0 {
+				t.Errorf("drift after reconciling: %v", drift)
+			}
+			if tt.wantTTLKept && (ua.InactivityTTL == nil || *ua.InactivityTTL != *tt.stored.InactivityTTL) {
+				t.Errorf("InactivityTTL = %v, want the stored %d", ua.InactivityTTL, *tt.stored.InactivityTTL)
+			}
+			if tt.wantGroupChanged {
+				// The time already spent inactive counts towards the new group's timeout
+				want := inactiveSince + (15 * time.Minute).Milliseconds()
+				if ua.InactiveSince == nil || *ua.InactiveSince != inactiveSince || ua.InactivityTTL == nil || *ua.InactivityTTL != want {
+					t.Errorf("inactive since %v with TTL %v, want %d with TTL %d", ua.InactiveSince, ua.InactivityTTL, inactiveSince, want)
+				}
+			}
+		})
+	}
+}
@@ -7,10 +7,14 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"user-activity-monitor/src/db"
 	"user-activity-monitor/src/genesys"
 	"user-activity-monitor/src/groupconfig"
+	"user-activity-monitor/src/scheduler"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -41,16 +45,30 @@ type ExtendedUserActivity struct {
 	SecondaryPresenceName string `json:"secondaryPresenceName"`
 	Status                string `json:"status"`
 	GroupName             string `json:"groupName"`
+	ExemptReason          string `json:"exemptReason,omitempty"`
+}
+
+type ExtendedReaperEvent struct {
+	db.ReaperEvent
+	UserName  string `json:"userName"`
+	GroupName string `json:"groupName"`
 }
 
 func main() {
-	lambda.Start(handleRequestLogger)
+	db.SetStore(db.NewDynamoDBStoreFromEnv())
+	db.SetScheduler(scheduler.FromEnv())
+	gc := genesys.NewClientFromEnv()
+	requestBudget := genesys.RequestBudgetFromEnv()
+	lambda.Start(func(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+		ctx = genesys.WithRequestBudget(ctx, requestBudget)
+		return handleRequestLogger(ctx, gc, request)
+	})
 }
 
-func handleRequestLogger(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+func handleRequestLogger(ctx context.Context, gc genesys.Client, request events.APIGatewayProxyRequest) (Response, error) {
 	fmt.Printf("Processing request data for request %s.\n", request.RequestContext.RequestID)
 
-	response, err := handleRequest(ctx, request)
+	response, err := handleRequest(ctx, gc, request)
 	if err != nil {
 		fmt.Printf("Error handling request: %v", err)
 		return Response{
@@ -65,7 +83,7 @@ func handleRequestLogger(ctx context.Context, request events.APIGatewayProxyRequ
 	return response, nil
 }
 
-func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+func handleRequest(ctx context.Context, gc genesys.Client, request events.APIGatewayProxyRequest) (Response, error) {
 	switch request.Path {
 	case "/report/data":
 		{
@@ -77,54 +95,105 @@ func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (
 				}, nil
 			}
 
-			// Get pending user activity records
-			pendingRecords, err := db.ListUserActivity(true, nil)
+			// Get the presences once for every status
+			presences, err := gc.GetPresences(ctx)
 			if err != nil {
-				fmt.Printf("Error listing pending user activity: %v", err)
+				fmt.Printf("Error getting presences: %v", err)
 				return Response{
 					StatusCode: 500,
 				}, nil
 			}
-			extendedPendingRecords, err := extendUserActivity(pendingRecords, "pending")
+
+			// Get user activity records for every status
+			var extendedRecords []ExtendedUserActivity
+			for _, status := range []string{db.StatusPending, db.StatusFailed, db.StatusExempt} {
+				records, err := db.ListUserActivity(status, nil)
+				if err != nil {
+					fmt.Printf("Error listing %s user activity: %v", status, err)
+					return Response{
+						StatusCode: 500,
+					}, nil
+				}
+				extendedStatusRecords, err := extendUserActivity(ctx, gc, records, status, presences)
+				if err != nil {
+					fmt.Printf("Error extending user activity: %v", err)
+					return Response{
+						StatusCode: 500,
+					}, nil
+				}
+				extendedRecords = append(extendedRecords, extendedStatusRecords...)
+			}
+
+			// Marshal the records to JSON
+			recordsJson, err := json.Marshal(extendedRecords)
 			if err != nil {
-				fmt.Printf("Error extending user activity: %v", err)
+				fmt.Printf("Error marshalling records: %v", err)
 				return Response{
 					StatusCode: 500,
 				}, nil
 			}
 
-			// Get exempt user activity records
-			exemptRecords, err := db.ListUserActivity(false, nil)
-			if err != nil {
-				fmt.Printf("Error listing exempt user activity: %v", err)
+			// Return the records
+			return Response{
+				StatusCode: 200,
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+				},
+				Body: string(recordsJson),
+			}, nil
+		}
+	case "/report/events":
+		{
+			// Validate authorization
+			if err := validateAuthorization(request); err != nil {
+				fmt.Printf("Authorization validation failed: %v", err)
 				return Response{
-					StatusCode: 500,
+					StatusCode: 401,
 				}, nil
 			}
-			extendedExemptRecords, err := extendUserActivity(exemptRecords, "exempt")
+
+			// Get reaper events for the lookback period
+			days := 7
+			if d, err := strconv.Atoi(request.QueryStringParameters["days"]); err == nil && d > 0 {
+				days = d
+			}
+			since := time.Now().AddDate(0, 0, -days).UnixMilli()
+
+			var reaperEvents []db.ReaperEvent
+			for _, action := range db.ReaperEventActions {
+				actionEvents, err := db.ListReaperEvents(action, since)
+				if err != nil {
+					fmt.Printf("Error listing %s reaper events: %v", action, err)
+					return Response{
+						StatusCode: 500,
+					}, nil
+				}
+				reaperEvents = append(reaperEvents, actionEvents...)
+			}
+			extendedReaperEvents, err := extendReaperEvents(ctx, gc, reaperEvents)
 			if err != nil {
-				fmt.Printf("Error extending user activity: %v", err)
+				fmt.Printf("Error extending reaper events: %v", err)
 				return Response{
 					StatusCode: 500,
 				}, nil
 			}
 
-			// Marshal the records to JSON
-			recordsJson, err := json.Marshal(append(extendedPendingRecords, extendedExemptRecords...))
+			// Marshal the events to JSON
+			eventsJson, err := json.Marshal(extendedReaperEvents)
 			if err != nil {
-				fmt.Printf("Error marshalling records: %v", err)
+				fmt.Printf("Error marshalling events: %v", err)
 				return Response{
 					StatusCode: 500,
 				}, nil
 			}
 
-			// Return the records
+			// Return the events
 			return Response{
 				StatusCode: 200,
 				Headers: map[string]string{
 					"Content-Type": "application/json",
 				},
-				Body: string(recordsJson),
+				Body: string(eventsJson),
 			}, nil
 		}
 	case "/report":
@@ -218,7 +287,7 @@ func validateAuthorization(request events.APIGatewayProxyRequest) error {
 	return nil
 }
 
-func extendUserActivity(userActivity []db.UserActivity, status string) ([]ExtendedUserActivity, error) {
+func extendUserActivity(ctx context.Context, gc genesys.Client, userActivity []db.UserActivity, status string, presences map[string]genesys.GenesysPresence) ([]ExtendedUserActivity, error) {
 	extendedUserActivities := make([]ExtendedUserActivity, len(userActivity))
 
 	// Collect all the user IDs
@@ -234,18 +303,16 @@ func extendUserActivity(userActivity []db.UserActivity, status string) ([]Extend
 	}
 
 	// Get the users
-	users, err := genesys.GetUsers(userIdsSlice)
+	users, err := gc.GetUsers(ctx, userIdsSlice)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get users: %w", err)
 	}
 
-	// Get the presences
-	presences, err := genesys.GetPresences()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get presences: %w", err)
-	}
+	// Get the timeout groups
+	timeoutGroups := groupconfig.GetTimeoutGroups()
 
 	// Extend the user activity
+	now := time.Now()
 	for i, activity := range userActivity {
 		secondaryPresenceName := "N/A"
 		if presence, exists := presences[activity.SecondaryPresenceID]; exists {
@@ -255,8 +322,8 @@ func extendUserActivity(userActivity []db.UserActivity, status string) ([]Extend
 		}
 
 		groupName := "N/A"
-		if group, exists := groupconfig.TimeoutGroups[activity.GroupID]; exists {
-			groupName = fmt.Sprintf("%s (%v minutes)", group.Name, group.TimeoutMinutes)
+		if group, exists := timeoutGroups[activity.GroupID]; exists {
+			groupName = fmt.Sprintf("%s (%v minutes)", group.Name, group.InactivityMinutes())
 		}
 
 		userName := "N/A"
@@ -266,14 +333,84 @@ func extendUserActivity(userActivity []db.UserActivity, status string) ([]Extend
 			userImage = user.GetImageThumbnail()
 		}
 
+		activityStatus := status
+		if status == db.StatusPending && activity.WarnedAt != nil {
+			activityStatus = "warned"
+		}
+		if status == db.StatusPending && activity.InactivityTTL == nil && activity.NextStepAt == nil &&
+			activity.NextLogoutRetry == nil {
+			// Only the session or ACW deadline is pending, the user is exempt from the inactivity TTL
+			activityStatus = db.StatusExempt
+		}
+		if status != db.StatusFailed && activity.IsStuckInACW(now) {
+			activityStatus = "stuck_acw"
+		}
+
+		// Explain the exemption with the group's current rules
+		exemptReason := ""
+		if activityStatus == db.StatusExempt || activityStatus == "stuck_acw" {
+			exemptReason = activity.ExemptReason()
+		}
+
 		extendedUserActivities[i] = ExtendedUserActivity{
 			UserActivity:          activity,
 			UserName:              userName,
 			UserImage:             userImage,
 			SecondaryPresenceName: secondaryPresenceName,
-			Status:                status,
+			Status:                activityStatus,
 			GroupName:             groupName,
+			ExemptReason:          exemptReason,
 		}
 	}
 	return extendedUserActivities, nil
 }
+
+func extendReaperEvents(ctx context.Context, gc genesys.Client, reaperEvents []db.ReaperEvent) ([]ExtendedReaperEvent, error) {
+	extendedReaperEvents := make([]ExtendedReaperEvent, len(reaperEvents))
+
+	// Newest events first
+	sort.Slice(reaperEvents, func(i, j int) bool {
+		return reaperEvents[i].Timestamp > reaperEvents[j].Timestamp
+	})
+
+	// Collect all the user IDs
+	userIds := make(map[string]bool)
+	for _, event := range reaperEvents {
+		userIds[event.UserID] = true
+	}
+
+	// Convert map to slice
+	userIdsSlice := make([]string, 0, len(userIds))
+	for userId := range userIds {
+		userIdsSlice = append(userIdsSlice, userId)
+	}
+
+	// Get the users
+	users, err := gc.GetUsers(ctx, userIdsSlice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	// Get the timeout groups
+	timeoutGroups := groupconfig.GetTimeoutGroups()
+
+	// Extend the reaper events
+	for i, event := range reaperEvents {
+		groupName := "N/A"
+		if group, exists := timeoutGroups[event.GroupID]; exists {
+			groupName = group.Name
+		}
+
+		userName := "N/A"
+		if user, exists := users[event.UserID]; exists {
+			userName = user.Name
+		}
+
+		extendedReaperEvents[i] = ExtendedReaperEvent{
+			ReaperEvent: event,
+			UserName:    userName,
+			GroupName:   groupName,
+		}
+	}
+	return extendedReaperEvents, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+	"user-activity-monitor/src/db"
+	"user-activity-monitor/src/genesys"
+	"user-activity-monitor/src/groupconfig"
+)
+
+const (
+	testGroupID = "0f6c1b4e-3d2a-4c8e-9b7f-5a1d2e3f4a5b"
+	testUserID  = "7d3e2c1b-4a5f-4e6d-8c7b-9a0f1e2d3c4b"
+)
+
+func TestExtendUserActivityStuckInACW(t *testing.T) {
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		testGroupID: {Name: "Timeout Group - test", TimeoutMinutes: 15, ACWPolicy: &groupconfig.ACWPolicy{MaxMinutes: 10}},
+	})
+	gc := genesys.NewFakeClient()
+	gc.Users[testUserID] = &genesys.GenesysUser{ID: testUserID, Name: "Test User"}
+
+	now := time.Now()
+	minutesAgo := func(minutes int) *int64 {
+		return &[]int64{now.Add(-time.Duration(minutes) * time.Minute).UnixMilli()}[0]
+	}
+
+	tests := []struct {
+		name             string
+		acwSince         *int64
+		status           string
+		wantStatus       string
+		wantExemptReason string
+	}{
+		{
+			name:             "in after-call work within the policy",
+			acwSince:         minutesAgo(5),
+			status:           db.StatusPending,
+			wantStatus:       db.StatusExempt,
+			wantExemptReason: "in after-call work on call",
+		},
+		{
+			name:             "in after-call work past the policy",
+			acwSince:         minutesAgo(20),
+			status:           db.StatusPending,
+			wantStatus:       "stuck_acw",
+			wantExemptReason: "in after-call work on call",
+		},
+		{
+			name:       "failed enforcement",
+			acwSince:   minutesAgo(20),
+			status:     db.StatusFailed,
+			wantStatus: db.StatusFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ua := db.UserActivity{
+				UserID:             testUserID,
+				GroupID:            testGroupID,
+				Presence:           "AVAILABLE",
+				Conversing:         true,
+				ConversingChannels: []string{"call"},
+				ACWSince:           tt.acwSince,
+			}
+			ua.CheckActivity()
+
+			extended, err := extendUserActivity(context.Background(), gc, []db.UserActivity{ua}, tt.status, nil)
+			if err != nil {
+				t.Fatalf("failed to extend user activity: %v", err)
+			}
+			if len(extended) != 1 {
+				t.Fatalf("extended %d user activities, want 1", len(extended))
+			}
+			if extended[0].Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", extended[0].Status, tt.wantStatus)
+			}
+			if extended[0].ExemptReason != tt.wantExemptReason {
+				t.Errorf("exempt reason = %q, want %q", extended[0].ExemptReason, tt.wantExemptReason)
+			}
+			if extended[0].UserName != "Test User" {
+				t.Errorf("user name = %q, want Test User", extended[0].UserName)
+			}
+		})
+	}
+}
+
+func TestExtendUserActivity(t *testing.T) {
+	groupconfig.SetTimeoutGroups(map[string]groupconfig.TimeoutGroup{
+		testGroupID: {Name: "Timeout Group - test", TimeoutMinutes: 15, WarningMinutes: 5},
+	})
+	gc := genesys.NewFakeClient()
+	gc.Users[testUserID] = &genesys.GenesysUser{
+		ID:     testUserID,
+		Name:   "Test User",
+		Images: []genesys.GenesysUserImage{{Resolution: "x48", ImageURI: "https://example.com/x48.png"}},
+	}
+	meetingID := "2c3d4e5f-6a7b-4c8d-9e0f-1a2b3c4d5e6f"
+	presences := map[string]genesys.GenesysPresence{
+		meetingID: {ID: meetingID, LanguageLabels: map[string]string{"en_US": "Meeting"}},
+	}
+
+	soon := time.Now().Add(10 * time.Minute).UnixMilli()
+	warned := time.Now().UnixMilli()
+	unknownUserID := "4d5e6f7a-8b9c-4d0e-9f1a-2b3c4d5e6f7a"
+
+	userActivity := []db.UserActivity{
+		{UserID: testUserID, GroupID: testGroupID, Presence: "AVAILABLE", SecondaryPresenceID: meetingID, InactivityTTL: &soon},
+		{UserID: testUserID, GroupID: testGroupID, Presence: "AVAILABLE", InactivityTTL: &soon, WarnedAt: &warned},
+		// Only the session deadline is pending, the user is exempt from the inactivity TTL
+		{UserID: testUserID, GroupID: testGroupID, Presence: "ON_QUEUE", SessionDeadline: &soon},
+		{UserID: unknownUserID, Presence: "AVAILABLE", InactivityTTL: &soon},
+	}
+
+	extended, err := extendUserActivity(context.Background(), gc, userActivity, db.StatusPending, presences)
+	if err != nil {
+		t.Fatalf("failed to extend user activity: %v", err)
+	}
+
+	want := []struct {
+		userName, userImage, secondaryPresenceName, status, groupName, exemptReason string
+	}{
+		{"Test User", "https://example.com/x48.png", "Meeting", db.StatusPending, "Timeout Group - test (15 minutes)", ""},
+		{"Test User", "https://example.com/x48.png", "N/A", "warned", "Timeout Group - test (15 minutes)", ""},
+		{"Test User", "https://example.com/x48.png", "N/A", db.StatusExempt, "Timeout Group - test (15 minutes)", "presence ON_QUEUE is exempt"},
+		{"N/A", "N/A", "N/A", db.StatusPending, "N/A", ""},
+	}
+	if len(extended) != len(want) {
+		t.Fatalf("extended %d user activities, want %d", len(extended), len(want))
+	}
+	for i, w := range want {
+		e := extended[i]
+		if e.UserName != w.userName || e.UserImage != w.userImage || e.SecondaryPresenceName != w.secondaryPresenceName ||
+			e.Status != w.status || e.GroupName != w.groupName || e.ExemptReason != w.exemptReason {
+			t.Errorf("user activity %d = %q, %q, %q, %q, %q, %q, want %+v", i, e.UserName, e.UserImage,
+				e.SecondaryPresenceName, e.Status, e.GroupName, e.ExemptReason, w)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/scheduler"
+	"github.com/aws/aws-sdk-go-v2/service/scheduler/types"
+)
+
+// EventBridgeScheduler creates one-shot EventBridge Scheduler schedules that invoke the reaper for a single user
+type EventBridgeScheduler struct {
+	groupName string
+	targetARN string
+	roleARN   string
+
+	once   sync.Once
+	client *scheduler.Client
+	err    error
+}
+
+func NewEventBridgeScheduler(groupName string, targetARN string, roleARN string) *EventBridgeScheduler {
+	if groupName == "" {
+		groupName = "default"
+	}
+	return &EventBridgeScheduler{
+		groupName: groupName,
+		targetARN: targetARN,
+		roleARN:   roleARN,
+	}
+}
+
+func (s *EventBridgeScheduler) getClient(ctx context.Context) (*scheduler.Client, error) {
+	s.once.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			s.err = fmt.Errorf("failed to load AWS config: %w", err)
+			return
+		}
+		s.client = scheduler.NewFromConfig(cfg)
+	})
+	return s.client, s.err
+}
+
+func (s *EventBridgeScheduler) Schedule(ctx context.Context, userID string, at time.Time) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	input, err := json.Marshal(map[string]string{"userId": userID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal schedule input: %w", err)
+	}
+
+	// Schedules have second precision, round up so the reap never runs before the deadline
+	at = at.Add(time.Second - time.Nanosecond).Truncate(time.Second)
+
+	name := scheduleName(userID)
+	expression := fmt.Sprintf("at(%s)", at.UTC().Format("2006-01-02T15:04:05"))
+	target := &types.Target{
+		Arn:     aws.String(s.targetARN),
+		RoleArn: aws.String(s.roleARN),
+		Input:   aws.String(string(input)),
+	}
+	flexibleTimeWindow := &types.FlexibleTimeWindow{Mode: types.FlexibleTimeWindowModeOff}
+
+	// Update the existing schedule, or create it if there is none
+	_, err = client.UpdateSchedule(ctx, &scheduler.UpdateScheduleInput{
+		Name:                       aws.String(name),
+		GroupName:                  aws.String(s.groupName),
+		ScheduleExpression:         aws.String(expression),
+		ScheduleExpressionTimezone: aws.String("UTC"),
+		FlexibleTimeWindow:         flexibleTimeWindow,
+		Target:                     target,
+		ActionAfterCompletion:      types.ActionAfterCompletionDelete,
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		_, err = client.CreateSchedule(ctx, &scheduler.CreateScheduleInput{
+			Name:                       aws.String(name),
+			GroupName:                  aws.String(s.groupName),
+			ScheduleExpression:         aws.String(expression),
+			ScheduleExpressionTimezone: aws.String("UTC"),
+			FlexibleTimeWindow:         flexibleTimeWindow,
+			Target:                     target,
+			ActionAfterCompletion:      types.ActionAfterCompletionDelete,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to schedule reap for %s: %w", userID, err)
+	}
+
+	return nil
+}
+
+func (s *EventBridgeScheduler) Cancel(ctx context.Context, userID string) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteSchedule(ctx, &scheduler.DeleteScheduleInput{
+		Name:      aws.String(scheduleName(userID)),
+		GroupName: aws.String(s.groupName),
+	})
+	var notFound *types.ResourceNotFoundException
+	if err != nil && !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to cancel reap schedule for %s: %w", userID, err)
+	}
+
+	return nil
+}
+
+func scheduleName(userID string) string {
+	return fmt.Sprintf("reap-%s", userID)
+}
@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+ * Per-user reap schedules
+ *
+ * The reaper polls for pending users every few minutes, so a user can be logged out up to one polling interval after
+ * their deadline. A Scheduler creates a one-shot schedule per user at their exact deadline which triggers a
+ * single-user reap. The polling reaper is kept as a safety net for missed or failed schedules.
+ */
+
+// Scheduler creates, updates and deletes one-shot per-user reap schedules
+type Scheduler interface {
+	// Schedule creates or updates the user's schedule to trigger at the time
+	Schedule(ctx context.Context, userID string, at time.Time) error
+	// Cancel deletes the user's schedule, if there is one
+	Cancel(ctx context.Context, userID string) error
+}
+
+// FromEnv returns an EventBridge Scheduler backend if REAP_SCHEDULE_TARGET_ARN is set, otherwise nil (disabled)
+func FromEnv() Scheduler {
+	targetARN := os.Getenv("REAP_SCHEDULE_TARGET_ARN")
+	if targetARN == "" {
+		return nil
+	}
+
+	return NewEventBridgeScheduler(os.Getenv("REAP_SCHEDULE_GROUP"), targetARN, os.Getenv("REAP_SCHEDULE_ROLE_ARN"))
+}
+
+// MemoryScheduler keeps schedules in memory; it is intended for tests and local runs
+type MemoryScheduler struct {
+	mu        sync.Mutex
+	schedules map[string]time.Time
+}
+
+func NewMemoryScheduler() *MemoryScheduler {
+	return &MemoryScheduler{
+		schedules: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryScheduler) Schedule(ctx context.Context, userID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedules[userID] = at
+	return nil
+}
+
+func (s *MemoryScheduler) Cancel(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.schedules, userID)
+	return nil
+}
+
+// Get returns the user's schedule
+func (s *MemoryScheduler) Get(userID string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.schedules[userID]
+	return at, ok
+}
+
+// Due removes and returns the IDs of the users whose schedules are due at the time, earliest first
+func (s *MemoryScheduler) Due(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var userIDs []string
+	for userID, at := range s.schedules {
+		if !at.After(now) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Slice(userIDs, func(i, j int) bool {
+		return s.schedules[userIDs[i]].Before(s.schedules[userIDs[j]])
+	})
+	for _, userID := range userIDs {
+		delete(s.schedules, userID)
+	}
+
+	return userIDs
+}
@@ -35,6 +35,10 @@ if [ ! -f "lambda/dist/reaperlambdafunction/reaperlambdafunction.zip" ]; then
     echo "❌ Failed to build reaperlambdafunction"
     exit 1
 fi
+if [ ! -f "lambda/dist/reconcilelambdafunction/reconcilelambdafunction.zip" ]; then
+    echo "❌ Failed to build reconcilelambdafunction"
+    exit 1
+fi
 
 echo "✅ Go binaries built successfully"
 